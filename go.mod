@@ -9,5 +9,8 @@ require (
 	github.com/schollz/pake v1.1.1
 	github.com/schollz/pake/v2 v2.0.2
 	github.com/stretchr/testify v1.4.0
+	golang.org/x/crypto v0.0.0-20200221231518-2aa609cf4a9d
+	golang.org/x/net v0.0.0-20200226121028-0de0cce0169b
+	golang.org/x/sys v0.0.0-20200223170610-d5e6a3e2c0ae
 	google.golang.org/appengine v1.6.5
 )
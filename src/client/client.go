@@ -0,0 +1,387 @@
+// Package client export interface for remote client program
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/miska12345/MiskaRFS/src/comm"
+	"github.com/miska12345/MiskaRFS/src/discovery"
+	"github.com/miska12345/MiskaRFS/src/fs"
+	"github.com/miska12345/MiskaRFS/src/host"
+	"github.com/miska12345/MiskaRFS/src/identity"
+	log "github.com/miska12345/MiskaRFS/src/logger"
+	msg "github.com/miska12345/MiskaRFS/src/message"
+	"github.com/miska12345/MiskaRFS/src/p2p"
+	"github.com/miska12345/MiskaRFS/src/tcp2"
+	"github.com/pkg/errors"
+	"github.com/schollz/croc/v8/src/crypt"
+)
+
+// Config describes which host to reach and how
+type Config struct {
+	Relay    string
+	Password string
+	Name     string
+	// KnownHostsFile pins host keys, defaults to ~/.miskarfs/known_hosts
+	KnownHostsFile string
+	Timeout        time.Duration
+	// Transport reaches the relay, defaults to WebSocket for ws:// and wss:// addresses and TCP otherwise
+	Transport comm.Transport
+	// Direct tries to reach the host without the relay once connected, keeping the relay if that fails
+	Direct bool
+}
+
+// Client is a connection to a remote host.
+// Its methods can be called at the same time, each waits only for the responses to its own request.
+type Client struct {
+	comm    *comm.Comm
+	key     []byte
+	HostKey string
+	// Direct tells whether the client reaches the host without the relay
+	Direct bool
+	// responses are read in the background once connected, see read
+	responses *router
+}
+
+// Connect reaches the host through the relay and verifies its identity
+func Connect(config *Config) (c *Client, err error) {
+	knownHostsFile := config.KnownHostsFile
+	if knownHostsFile == "" {
+		knownHostsFile = filepath.Join(identity.DefaultDir(), "known_hosts")
+	}
+	knownHosts, err := identity.LoadKnownHosts(knownHostsFile)
+	if err != nil {
+		return
+	}
+
+	transport := config.Transport
+	if transport == nil {
+		transport = comm.TransportFor(config.Relay)
+	}
+	var peer *p2p.Peer
+	req := &tcp2.RoomRequest{Room: config.Name}
+	if config.Direct {
+		if peer, err = p2p.Listen(":0"); err != nil {
+			return
+		}
+		defer peer.Close()
+		req.Addresses = peer.Addresses()
+	}
+	var conn *comm.Comm
+	if config.Timeout > 0 {
+		conn, err = tcp2.JoinRoom(transport, config.Relay, config.Password, req, config.Timeout)
+	} else {
+		conn, err = tcp2.JoinRoom(transport, config.Relay, config.Password, req)
+	}
+	if err != nil {
+		return
+	}
+	// Wait for the relay to bridge us to the host
+	var info *tcp2.PeerInfo
+	for {
+		data, err := conn.Receive()
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if bytes.Equal(data, []byte("ok")) {
+			break
+		}
+		if closed := tcp2.ParseCloseNotice(data); closed != nil {
+			conn.Close()
+			return nil, closed
+		}
+		if p := tcp2.ParsePeerInfo(data); p != nil {
+			info = p
+		}
+	}
+
+	c = &Client{comm: conn}
+	if err = c.handshake(config.Name, knownHosts); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if peer != nil && info != nil {
+		if err := c.goDirect(peer, info); err != nil {
+			log.Debugf("Staying on the relay: %s", err)
+		}
+	}
+	c.responses = newRouter()
+	go c.read()
+	return c, nil
+}
+
+// read routes what the host sends to the requests waiting for it until the connection ends
+func (c *Client) read() {
+	for {
+		res, err := c.receive()
+		if err != nil {
+			c.responses.fail(err)
+			return
+		}
+		c.responses.route(res)
+	}
+}
+
+// directTimeout bounds how long the client tries to reach the host without the relay
+var directTimeout = 3 * time.Second
+
+// goDirect asks the host to meet it at one of the addresses in info and,
+// if they manage to, leaves the relay for the direct connection
+func (c *Client) goDirect(peer *p2p.Peer, info *tcp2.PeerInfo) error {
+	nonce, err := p2p.NewNonce()
+	if err != nil {
+		return err
+	}
+	if err = c.send(msg.TYPE_DIRECT, nonce); err != nil {
+		return err
+	}
+	res, err := c.receive()
+	if err != nil {
+		return err
+	}
+	if res.Type != msg.TYPE_DIRECT {
+		return fmt.Errorf("Host refused: %s", res.Msg)
+	}
+	conn, err := peer.Dial(p2p.Candidates(info.Observed, info.Addresses), directTimeout, c.key, nonce)
+	if err != nil {
+		return err
+	}
+	log.Debugf("Connected directly to %s", conn.RemoteAddr())
+	c.comm.Close()
+	c.comm = comm.New(conn)
+	c.Direct = true
+	return nil
+}
+
+// ListHosts returns the public hosts on the relay, config.Name is ignored
+func ListHosts(config *Config) ([]tcp2.RoomStatus, error) {
+	transport := config.Transport
+	if transport == nil {
+		transport = comm.TransportFor(config.Relay)
+	}
+	if config.Timeout > 0 {
+		return tcp2.ListRooms(transport, config.Relay, config.Password, config.Timeout)
+	}
+	return tcp2.ListRooms(transport, config.Relay, config.Password)
+}
+
+// Browse finds hosts announcing themselves on the local network for timeout.
+// Connect to one with its Address as the Relay and its Name as the Name.
+func Browse(config *discovery.Config, timeout time.Duration) ([]discovery.Service, error) {
+	return discovery.Browse(config, timeout)
+}
+
+func (c *Client) handshake(name string, knownHosts *identity.KnownHosts) error {
+	hs, err := identity.NewHandshake(name)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(hs.Hello())
+	if err != nil {
+		return err
+	}
+	if err = c.send(msg.TYPE_HELLO, string(body)); err != nil {
+		return err
+	}
+	res, err := c.receive()
+	if err != nil {
+		return err
+	}
+	if res.Type != msg.TYPE_HELLO {
+		return fmt.Errorf("Handshake failed: %s", res.Msg)
+	}
+	var sh identity.ServerHello
+	if err = json.Unmarshal([]byte(res.Msg), &sh); err != nil {
+		return errors.Wrap(err, "Handshake failed")
+	}
+	key, err := hs.Finish(&sh)
+	if err != nil {
+		return err
+	}
+	if err = knownHosts.Check(name, sh.Identity); err != nil {
+		return err
+	}
+	c.key = key
+	c.HostKey = identity.Fingerprint(sh.Identity)
+	log.Debugf("Connected to %s %s", name, c.HostKey)
+	return nil
+}
+
+// Run executes cmd on the host and returns its response
+func (c *Client) Run(cmd string) (*msg.Message, error) {
+	id, box, err := c.request(cmd)
+	if err != nil {
+		return nil, err
+	}
+	defer c.responses.close(id)
+	for {
+		res, err := c.responses.next(box)
+		if err != nil || res.Type != msg.TYPE_STREAM {
+			return res, err
+		}
+	}
+}
+
+// request sends cmd to the host, returning its ID and where its responses go
+func (c *Client) request(cmd string) (string, *mailbox, error) {
+	id := msg.NewID()
+	box, err := c.responses.open(id)
+	if err != nil {
+		return "", nil, err
+	}
+	if err = c.sendRequest(host.Request{Type: "text/cmd", Body: cmd, ID: id}); err != nil {
+		c.responses.close(id)
+		return "", nil, err
+	}
+	return id, box, nil
+}
+
+// Stream executes a streaming cmd on the host, handing each part of the response to each as it arrives,
+// and returns the last part. If each fails the host is asked to stop and Stream returns that error
+// once it has.
+func (c *Client) Stream(cmd string, each func(*msg.Message) error) (*msg.Message, error) {
+	id, box, err := c.request(cmd)
+	if err != nil {
+		return nil, err
+	}
+	defer c.responses.close(id)
+	var stopped error
+	for {
+		res, err := c.responses.next(box)
+		if err != nil {
+			return nil, err
+		}
+		if res.Type != msg.TYPE_STREAM {
+			return res, stopped
+		}
+		if stopped != nil {
+			// Parts already on their way when the host was asked to stop
+			continue
+		}
+		if stopped = each(res); stopped != nil {
+			if err = c.send(msg.TYPE_CANCEL, id); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// Subscription is a streaming command running in the background, see Subscribe
+type Subscription struct {
+	c    *Client
+	id   string
+	done chan struct{}
+	// last and err are what ended it, set once done is closed
+	last *msg.Message
+	err  error
+}
+
+// Subscribe starts a streaming cmd on the host and returns at once, handing each part of the response
+// to each as it arrives while other commands are run. It goes on until the host is done or Unsubscribe
+// is called. each is called from a goroutine of its own, one part at a time.
+func (c *Client) Subscribe(cmd string, each func(*msg.Message)) (*Subscription, error) {
+	id, box, err := c.request(cmd)
+	if err != nil {
+		return nil, err
+	}
+	s := &Subscription{c: c, id: id, done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		defer c.responses.close(id)
+		for {
+			res, err := c.responses.next(box)
+			if err != nil {
+				s.err = err
+				return
+			}
+			if res.Type != msg.TYPE_STREAM {
+				s.last = res
+				return
+			}
+			each(res)
+		}
+	}()
+	return s, nil
+}
+
+// Done is closed once the subscription has ended
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Unsubscribe asks the host to stop and returns the last part of the response once it has
+func (s *Subscription) Unsubscribe() (*msg.Message, error) {
+	select {
+	case <-s.done:
+	default:
+		if err := s.c.send(msg.TYPE_CANCEL, s.id); err != nil {
+			return nil, err
+		}
+		<-s.done
+	}
+	return s.last, s.err
+}
+
+// Watch subscribes to changes under path on the host, the current directory if it is empty,
+// handing each to each. Events for invisible files never arrive.
+func (c *Client) Watch(path string, each func(fs.WatchEvent)) (*Subscription, error) {
+	return c.Subscribe(strings.TrimSpace("watch "+path), func(m *msg.Message) {
+		var events []fs.WatchEvent
+		if err := json.Unmarshal([]byte(m.Msg), &events); err != nil {
+			log.Debugf("Unexpected watch part: %s", err)
+			return
+		}
+		for _, e := range events {
+			each(e)
+		}
+	})
+}
+
+// Close ends the connection
+func (c *Client) Close() {
+	c.comm.Close()
+}
+
+func (c *Client) send(reqType, body string) error {
+	return c.sendRequest(host.Request{
+		Type: reqType,
+		Body: body,
+	})
+}
+
+func (c *Client) sendRequest(req host.Request) error {
+	bs, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	if c.key != nil {
+		bs, err = crypt.Encrypt(bs, c.key)
+		if err != nil {
+			return err
+		}
+	}
+	return c.comm.Send(bs)
+}
+
+func (c *Client) receive() (*msg.Message, error) {
+	data, err := c.comm.Receive()
+	if err != nil {
+		return nil, err
+	}
+	if closed := tcp2.ParseCloseNotice(data); closed != nil {
+		return nil, closed
+	}
+	if c.key != nil {
+		data, err = crypt.Decrypt(data, c.key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return msg.ConvertFromNetForm(data)
+}
@@ -0,0 +1,513 @@
+package client_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miska12345/MiskaRFS/src/client"
+	"github.com/miska12345/MiskaRFS/src/comm"
+	"github.com/miska12345/MiskaRFS/src/discovery"
+	"github.com/miska12345/MiskaRFS/src/fs"
+	"github.com/miska12345/MiskaRFS/src/host"
+	"github.com/miska12345/MiskaRFS/src/identity"
+	log "github.com/miska12345/MiskaRFS/src/logger"
+	msg "github.com/miska12345/MiskaRFS/src/message"
+	"github.com/miska12345/MiskaRFS/src/metrics"
+	"github.com/miska12345/MiskaRFS/src/tcp2"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	// Every relay sets the level as it starts, it must already be the one they ask for
+	log.SetLevel("error")
+	os.Exit(m.Run())
+}
+
+// startHost runs a relay and a host named pc-admin on an in-memory network until the test ends
+func startHost(t *testing.T, dir string) *comm.Memory {
+	memory := comm.NewMemory()
+	l, err := memory.Listen("relay")
+	assert.Nil(t, err)
+	serveRelay(t, l)
+	runHost(t, &host.ModuleConfig{
+		Name:         "pc-admin",
+		BaseDir:      dir,
+		IdentityFile: filepath.Join(dir, "host_ed25519"),
+		Relay:        "relay",
+		Transport:    memory,
+		Public:       true,
+	})
+	waitForRoom(t, memory, "relay", "pc-admin")
+	return memory
+}
+
+// serveRelay runs a relay on l until the test ends
+func serveRelay(t *testing.T, l net.Listener) {
+	done := make(chan struct{})
+	go func() {
+		tcp2.Serve(l, "error", "")
+		close(done)
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		<-done
+	})
+}
+
+// runHost runs a host until the test ends
+func runHost(t *testing.T, config *host.ModuleConfig) {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	config.Stop = stop
+	go func() {
+		host.Run(config)
+		close(done)
+	}()
+	// Cleanups run last added first, hosts stop before their relay
+	t.Cleanup(func() {
+		close(stop)
+		<-done
+	})
+}
+
+// waitForRoom waits for a public room to be listed by the relay
+func waitForRoom(t *testing.T, transport comm.Transport, relay, room string) {
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		rooms, _ := tcp2.ListRooms(transport, relay, "")
+		for _, r := range rooms {
+			if r.Name == room {
+				return
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("%s never opened on %s", room, relay)
+}
+
+// response leaves out the ID of the request res answers
+func response(res *msg.Message) *msg.Message {
+	if res == nil {
+		return nil
+	}
+	return msg.New(res.Type, res.Msg)
+}
+
+func TestConnect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "client")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	memory := startHost(t, dir)
+
+	config := &client.Config{
+		Relay:          "relay",
+		Name:           "pc-admin",
+		KnownHostsFile: filepath.Join(dir, "known_hosts"),
+		Transport:      memory,
+	}
+	c, err := client.Connect(config)
+	assert.Nil(t, err)
+	res, err := c.Run("echo hello")
+	assert.Nil(t, err)
+	assert.Equal(t, msg.New(msg.TYPE_RESPONSE, "hello"), response(res))
+	c.Close()
+
+	var buf bytes.Buffer
+	assert.Nil(t, metrics.Default.WriteText(&buf))
+	assert.Contains(t, buf.String(), `miskarfs_host_commands_total{feature="echo"} 1`)
+	assert.Contains(t, buf.String(), `miskarfs_relay_handshakes_total{result="succeeded"}`)
+
+	// The room is reusable and the pinned key still matches
+	time.Sleep(200 * time.Millisecond)
+	c, err = client.Connect(config)
+	assert.Nil(t, err)
+	res, err = c.Run("nope")
+	assert.Nil(t, err)
+	assert.Equal(t, msg.TYPE_ERROR, res.Type)
+	c.Close()
+}
+
+func TestConnectKeyMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "client")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	memory := startHost(t, dir)
+
+	// Pin some other key for pc-admin
+	impostor, err := identity.Generate()
+	assert.Nil(t, err)
+	kh, err := identity.LoadKnownHosts(filepath.Join(dir, "known_hosts"))
+	assert.Nil(t, err)
+	assert.Nil(t, kh.Check("pc-admin", impostor.Public))
+
+	_, err = client.Connect(&client.Config{
+		Relay:          "relay",
+		Name:           "pc-admin",
+		KnownHostsFile: filepath.Join(dir, "known_hosts"),
+		Transport:      memory,
+	})
+	_, ok := err.(*identity.KeyMismatchError)
+	assert.True(t, ok, "%v", err)
+}
+
+func TestConnectDirect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "client")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	serveRelay(t, l)
+	relay := l.Addr().String()
+
+	start := func(name, direct string) {
+		runHost(t, &host.ModuleConfig{
+			Name:         name,
+			BaseDir:      dir,
+			IdentityFile: filepath.Join(dir, name+"_ed25519"),
+			Relay:        relay,
+			Direct:       direct,
+			Public:       true,
+		})
+		waitForRoom(t, comm.TCP, relay, name)
+	}
+	start("direct", "127.0.0.1:0")
+	start("relayed", "")
+
+	for name, direct := range map[string]bool{"direct": true, "relayed": false} {
+		c, err := client.Connect(&client.Config{
+			Relay:          relay,
+			Name:           name,
+			KnownHostsFile: filepath.Join(dir, "known_hosts"),
+			Direct:         true,
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, direct, c.Direct, name)
+		res, err := c.Run("echo hello")
+		assert.Nil(t, err)
+		assert.Equal(t, msg.New(msg.TYPE_RESPONSE, "hello"), response(res))
+		c.Close()
+	}
+}
+
+func TestConnectLAN(t *testing.T) {
+	dir, err := ioutil.TempDir("", "client")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip("no loopback interface")
+	}
+	lan := &discovery.Config{Group: "239.255.77.79:7759", Interface: lo, Interval: 50 * time.Millisecond}
+
+	// No relay anywhere
+	runHost(t, &host.ModuleConfig{
+		Name:         "pc-lan",
+		BaseDir:      dir,
+		IdentityFile: filepath.Join(dir, "host_ed25519"),
+		Password:     "secret",
+		LAN:          true,
+		Discovery:    lan,
+	})
+
+	services, err := client.Browse(lan, time.Second)
+	assert.Nil(t, err)
+	if !assert.Len(t, services, 1) {
+		return
+	}
+	assert.Equal(t, "pc-lan", services[0].Name)
+
+	config := &client.Config{
+		Relay:          services[0].Address,
+		Password:       "secret",
+		Name:           services[0].Name,
+		KnownHostsFile: filepath.Join(dir, "known_hosts"),
+	}
+	c, err := client.Connect(config)
+	assert.Nil(t, err)
+	assert.Equal(t, services[0].Fingerprint, c.HostKey)
+	res, err := c.Run("echo hello")
+	assert.Nil(t, err)
+	assert.Equal(t, msg.New(msg.TYPE_RESPONSE, "hello"), response(res))
+	c.Close()
+
+	config.Password = "wrong"
+	_, err = client.Connect(config)
+	assert.NotNil(t, err)
+}
+
+func TestConnectHostAddress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "client")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	// Find a free port for the host
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	address := l.Addr().String()
+	l.Close()
+
+	runHost(t, &host.ModuleConfig{
+		Name:         "pc-admin",
+		BaseDir:      dir,
+		IdentityFile: filepath.Join(dir, "host_ed25519"),
+		Password:     "secret",
+		Listen:       address,
+		ListenLimits: tcp2.Limits{BanAfterBadPasswords: 2},
+	})
+	time.Sleep(200 * time.Millisecond)
+
+	// Clients are served at the same time, not one after the other
+	var clients []*client.Client
+	for i := 0; i < 5; i++ {
+		c, err := client.Connect(&client.Config{
+			Relay:          address,
+			Password:       "secret",
+			Name:           "pc-admin",
+			KnownHostsFile: filepath.Join(dir, "known_hosts"),
+		})
+		if !assert.Nil(t, err) {
+			return
+		}
+		defer c.Close()
+		clients = append(clients, c)
+	}
+	for i, c := range clients {
+		res, err := c.Run(fmt.Sprintf("echo %d", i))
+		assert.Nil(t, err)
+		assert.Equal(t, msg.New(msg.TYPE_RESPONSE, fmt.Sprint(i)), response(res))
+	}
+
+	// Only the host's own name is served
+	_, err = client.Connect(&client.Config{
+		Relay:          address,
+		Password:       "secret",
+		Name:           "someone-else",
+		KnownHostsFile: filepath.Join(dir, "known_hosts"),
+	})
+	assert.NotNil(t, err)
+
+	// Guessing the password gets the address banned, the right one doesn't help after
+	for _, password := range []string{"guess", "guess", "secret"} {
+		_, err = client.Connect(&client.Config{
+			Relay:          address,
+			Password:       password,
+			Name:           "pc-admin",
+			KnownHostsFile: filepath.Join(dir, "known_hosts"),
+		})
+		assert.NotNil(t, err)
+	}
+}
+
+func TestStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "client")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	for i := 0; i < 300; i++ {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("f%03d.log", i)), []byte("line\n"), 0644))
+	}
+	memory := startHost(t, dir)
+	c, err := client.Connect(&client.Config{
+		Relay:          "relay",
+		Name:           "pc-admin",
+		KnownHostsFile: filepath.Join(dir, "known_hosts"),
+		Transport:      memory,
+	})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer c.Close()
+
+	parts := 0
+	ids := make(map[string]bool)
+	res, err := c.Stream("find / -name *.log", func(m *msg.Message) error {
+		parts++
+		ids[m.ID] = true
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, `{"Matches":300,"Cancelled":false}`, res.Msg)
+	assert.True(t, parts > 1)
+	// Every part names the request it answers
+	assert.NotEmpty(t, res.ID)
+	assert.Equal(t, map[string]bool{res.ID: true}, ids)
+
+	// Stopping early cancels the stream on the host, even one that would never end by itself
+	stop := fmt.Errorf("seen enough")
+	res, err = c.Stream("tail -f f000.log", func(m *msg.Message) error {
+		return stop
+	})
+	assert.Equal(t, stop, err)
+	if assert.NotNil(t, res) {
+		assert.Equal(t, msg.TYPE_RESPONSE, res.Type, res.Msg)
+	}
+
+	// The connection is still good afterwards
+	res, err = c.Run("echo hello")
+	assert.Nil(t, err)
+	assert.Equal(t, msg.New(msg.TYPE_RESPONSE, "hello"), response(res))
+}
+
+func TestClientCantSpeakForRelay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "client")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	memory := startHost(t, dir)
+
+	// A client pretending to be the relay, telling the host its room is closed
+	// or that the next client is to be dialed somewhere
+	for _, frame := range []string{
+		"\x02miskarfs-relay-close:bye",
+		"\x03miskarfs-relay-peer:" + `{"Observed":"127.0.0.1:1","Addresses":["127.0.0.1:1"]}`,
+	} {
+		c, err := tcp2.JoinRoom(memory, "relay", "", &tcp2.RoomRequest{Room: "pc-admin"})
+		assert.Nil(t, err)
+		if err != nil {
+			return
+		}
+		for {
+			data, err := c.Receive()
+			assert.Nil(t, err)
+			if err != nil || string(data) == "ok" {
+				break
+			}
+		}
+		assert.Nil(t, c.Send([]byte(frame)))
+		// The relay hangs up on it
+		_, err = c.Receive()
+		assert.NotNil(t, err)
+		c.Close()
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	cl, err := client.Connect(&client.Config{
+		Relay:          "relay",
+		Name:           "pc-admin",
+		KnownHostsFile: filepath.Join(dir, "known_hosts"),
+		Transport:      memory,
+	})
+	assert.Nil(t, err)
+	if err != nil {
+		return
+	}
+	defer cl.Close()
+	res, err := cl.Run("echo hello")
+	assert.Nil(t, err)
+	assert.Equal(t, msg.New(msg.TYPE_RESPONSE, "hello"), response(res))
+}
+
+func TestStreamsEndWithClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "client")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	memory := startHost(t, dir)
+	log := filepath.Join(dir, "app.log")
+	assert.Nil(t, ioutil.WriteFile(log, []byte("start\n"), 0644))
+	config := &client.Config{
+		Relay:          "relay",
+		Name:           "pc-admin",
+		KnownHostsFile: filepath.Join(dir, "known_hosts"),
+		Transport:      memory,
+	}
+
+	// A client following the log leaves without cancelling
+	c, err := client.Connect(config)
+	assert.Nil(t, err)
+	parts := make(chan *msg.Message, 100)
+	go c.Stream("tail -f app.log", func(m *msg.Message) error {
+		parts <- m
+		return nil
+	})
+	<-parts
+	c.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	// The log goes on growing, none of it reaches the next client
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(50 * time.Millisecond):
+			}
+			f, err := os.OpenFile(log, os.O_APPEND|os.O_WRONLY, 0)
+			if err != nil {
+				return
+			}
+			f.WriteString("more\n")
+			f.Close()
+		}
+	}()
+	c, err = client.Connect(config)
+	assert.Nil(t, err)
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	for i := 0; i < 10; i++ {
+		res, err := c.Run("echo hello")
+		assert.Nil(t, err)
+		assert.Equal(t, msg.New(msg.TYPE_RESPONSE, "hello"), response(res))
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "client")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	memory := startHost(t, dir)
+	c, err := client.Connect(&client.Config{
+		Relay:          "relay",
+		Name:           "pc-admin",
+		KnownHostsFile: filepath.Join(dir, "known_hosts"),
+		Transport:      memory,
+	})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer c.Close()
+
+	events := make(chan fs.WatchEvent, 100)
+	sub, err := c.Watch("", func(e fs.WatchEvent) {
+		events <- e
+	})
+	if !assert.Nil(t, err) {
+		return
+	}
+	// Give the host time to start watching
+	time.Sleep(200 * time.Millisecond)
+
+	// Other commands go on being answered while the watch runs
+	for i := 0; i < 3; i++ {
+		res, err := c.Run("echo hello")
+		assert.Nil(t, err)
+		assert.Equal(t, msg.New(msg.TYPE_RESPONSE, "hello"), response(res))
+	}
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "new.txt"), nil, 0644))
+	select {
+	case e := <-events:
+		assert.Equal(t, "/new.txt", e.Path)
+	case <-time.After(5 * time.Second):
+		t.Fatal("No event for the new file")
+	}
+
+	res, err := sub.Unsubscribe()
+	assert.Nil(t, err)
+	if assert.NotNil(t, res) {
+		assert.Equal(t, msg.TYPE_RESPONSE, res.Type)
+	}
+	<-sub.Done()
+
+	res, err = c.Run("echo hello")
+	assert.Nil(t, err)
+	assert.Equal(t, msg.New(msg.TYPE_RESPONSE, "hello"), response(res))
+}
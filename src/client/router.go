@@ -0,0 +1,110 @@
+package client
+
+import (
+	"sync"
+
+	log "github.com/miska12345/MiskaRFS/src/logger"
+	msg "github.com/miska12345/MiskaRFS/src/message"
+)
+
+// router hands each response from the host to the request it answers, so that requests
+// running at the same time, like a watch and the commands run meanwhile, don't get in each other's way
+type router struct {
+	pending map[string]*mailbox
+	// err is why responses stopped coming, every request waiting or made after gets it
+	err error
+	sync.Mutex
+}
+
+// mailbox queues the responses to a request until they are taken.
+// It never blocks the router, however slowly its request takes them.
+type mailbox struct {
+	queue []*msg.Message
+	// ready has a value while there may be something to take
+	ready chan struct{}
+}
+
+func newRouter() *router {
+	return &router{pending: make(map[string]*mailbox)}
+}
+
+// open makes a mailbox for the responses to request id, failing if responses have stopped coming
+func (r *router) open(id string) (*mailbox, error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.err != nil {
+		return nil, r.err
+	}
+	box := &mailbox{ready: make(chan struct{}, 1)}
+	r.pending[id] = box
+	return box, nil
+}
+
+// close drops the mailbox of request id, responses to it are dropped from then on
+func (r *router) close(id string) {
+	r.Lock()
+	delete(r.pending, id)
+	r.Unlock()
+}
+
+// route puts m in the mailbox of the request it answers
+func (r *router) route(m *msg.Message) {
+	r.Lock()
+	defer r.Unlock()
+	if m.ID == "" {
+		// The host couldn't tell which request it answers, like when failing to read one
+		for _, box := range r.pending {
+			box.put(m)
+		}
+		return
+	}
+	box, ok := r.pending[m.ID]
+	if !ok {
+		log.Debugf("Dropped a response to request %s", m.ID)
+		return
+	}
+	box.put(m)
+}
+
+// fail stops the router, waking every request waiting on it
+func (r *router) fail(err error) {
+	r.Lock()
+	defer r.Unlock()
+	r.err = err
+	for _, box := range r.pending {
+		box.wake()
+	}
+}
+
+// next waits for the next response in box
+func (r *router) next(box *mailbox) (*msg.Message, error) {
+	for {
+		r.Lock()
+		if len(box.queue) > 0 {
+			m := box.queue[0]
+			box.queue[0] = nil
+			box.queue = box.queue[1:]
+			r.Unlock()
+			return m, nil
+		}
+		err := r.err
+		r.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		<-box.ready
+	}
+}
+
+// put is called with the router locked
+func (box *mailbox) put(m *msg.Message) {
+	box.queue = append(box.queue, m)
+	box.wake()
+}
+
+func (box *mailbox) wake() {
+	select {
+	case box.ready <- struct{}{}:
+	default:
+	}
+}
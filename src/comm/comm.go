@@ -1,27 +1,84 @@
 package comm
 
 import (
-	"bytes"
+	"crypto/tls"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 )
 
+// DefaultMaxFrameSize is the largest frame a Comm accepts unless told otherwise
+const DefaultMaxFrameSize = 32 * 1024 * 1024
+
+// HeaderSize is the length of the little endian size in front of every frame
+const HeaderSize = 4
+
+// Timeouts are refreshed on every frame, a zero value disables that timeout
+type Timeouts struct {
+	// Idle is how long Read waits for the next frame to start
+	Idle time.Duration
+	// Read is how long the rest of a frame may take once its header arrived
+	Read time.Duration
+	// Write is how long writing a frame may take
+	Write time.Duration
+}
+
+// DefaultTimeouts is what New uses
+var DefaultTimeouts = Timeouts{
+	Idle:  3 * time.Hour,
+	Read:  10 * time.Minute,
+	Write: 10 * time.Minute,
+}
+
 // Comm is some basic TCP communication
 type Comm struct {
-	connection net.Conn
+	connection   net.Conn
+	maxFrameSize int
+	timeouts     Timeouts
+	header       [HeaderSize]byte
+	writeLock    sync.Mutex
+}
+
+// ConnectionOption changes how NewConnection connects
+type ConnectionOption func(*connectionOptions)
+
+type connectionOptions struct {
+	timeout time.Duration
+	tls     *tls.Config
+}
+
+// WithTimeout bounds how long NewConnection may take to connect, 30 seconds by default
+func WithTimeout(d time.Duration) ConnectionOption {
+	return func(o *connectionOptions) {
+		o.timeout = d
+	}
 }
 
 // NewConnection gets a new comm to a tcp address
-func NewConnection(address string, timelimit ...time.Duration) (c *Comm, err error) {
+func NewConnection(address string, options ...ConnectionOption) (c *Comm, err error) {
+	o := connectionOptions{timeout: 30 * time.Second}
+	for _, option := range options {
+		option(&o)
+	}
+	t := TCP
+	if o.tls != nil {
+		t = TLS(t, o.tls)
+	}
+	return Dial(t, address, o.timeout)
+}
+
+// Dial gets a new comm to an address on the given transport
+func Dial(t Transport, address string, timelimit ...time.Duration) (c *Comm, err error) {
 	tlimit := 30 * time.Second
 	if len(timelimit) > 0 {
 		tlimit = timelimit[0]
 	}
-	connection, err := net.DialTimeout("tcp", address, tlimit)
+	connection, err := t.Dial(address, tlimit)
 	if err != nil {
 		return
 	}
@@ -31,14 +88,23 @@ func NewConnection(address string, timelimit ...time.Duration) (c *Comm, err err
 
 // New returns a new comm
 func New(c net.Conn) *Comm {
-	c.SetReadDeadline(time.Now().Add(3 * time.Hour))
-	c.SetDeadline(time.Now().Add(3 * time.Hour))
-	c.SetWriteDeadline(time.Now().Add(3 * time.Hour))
 	comm := new(Comm)
 	comm.connection = c
+	comm.maxFrameSize = DefaultMaxFrameSize
+	comm.timeouts = DefaultTimeouts
 	return comm
 }
 
+// SetTimeouts replaces the timeouts applied to following reads and writes
+func (c *Comm) SetTimeouts(t Timeouts) {
+	c.timeouts = t
+}
+
+// SetMaxFrameSize sets the largest frame that may be read or written
+func (c *Comm) SetMaxFrameSize(n int) {
+	c.maxFrameSize = n
+}
+
 // Connection returns the net.Conn connection
 func (c *Comm) Connection() net.Conn {
 	return c.connection
@@ -49,66 +115,69 @@ func (c *Comm) Close() {
 	c.connection.Close()
 }
 
-func (c *Comm) Write(b []byte) (int, error) {
-	header := new(bytes.Buffer)
-	err := binary.Write(header, binary.LittleEndian, uint32(len(b)))
-	if err != nil {
-		fmt.Println("binary.Write failed:", err)
+func (c *Comm) Write(b []byte) (n int, err error) {
+	if len(b) > c.maxFrameSize {
+		return 0, &FrameError{Kind: ErrFrameTooLarge, Size: len(b), Max: c.maxFrameSize}
 	}
-	tmpCopy := append(header.Bytes(), b...)
-	n, err := c.connection.Write(tmpCopy)
+	tmpCopy := getBuffer(HeaderSize + len(b))
+	defer putBuffer(tmpCopy)
+	binary.LittleEndian.PutUint32(tmpCopy, uint32(len(b)))
+	copy(tmpCopy[HeaderSize:], b)
+
+	c.writeLock.Lock()
+	c.connection.SetWriteDeadline(deadline(c.timeouts.Write))
+	n, err = c.connection.Write(tmpCopy)
+	c.writeLock.Unlock()
 	if n != len(tmpCopy) {
 		if err != nil {
-			err = errors.Wrap(err, fmt.Sprintf("wanted to write %d but wrote %d", len(b), n))
+			err = errors.Wrap(err, fmt.Sprintf("wanted to write %d but wrote %d", len(tmpCopy), n))
 		} else {
-			err = fmt.Errorf("wanted to write %d but wrote %d", len(b), n)
+			err = fmt.Errorf("wanted to write %d but wrote %d", len(tmpCopy), n)
 		}
 	}
-	// log.Printf("wanted to write %d but wrote %d", n, len(b))
 	return n, err
 }
 
+// Read reads a single frame.
+// buf may come from the buffer pool, hand it back with Recycle once done with it.
 func (c *Comm) Read() (buf []byte, numBytes int, bs []byte, err error) {
 	// read until we get 4 bytes for the header
-	var header []byte
-	numBytes = 4
-	for {
-		tmp := make([]byte, numBytes-len(header))
-		n, errRead := c.connection.Read(tmp)
-		if errRead != nil {
-			err = errRead
-			return
-		}
-		header = append(header, tmp[:n]...)
-		if numBytes == len(header) {
-			break
+	header := c.header[:]
+	c.connection.SetReadDeadline(deadline(c.timeouts.Idle))
+	if _, err = io.ReadFull(c.connection, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = &FrameError{Kind: ErrMalformedFrame, Err: err}
 		}
+		return
 	}
 
-	var numBytesUint32 uint32
-	rbuf := bytes.NewReader(header)
-	err = binary.Read(rbuf, binary.LittleEndian, &numBytesUint32)
-	if err != nil {
-		fmt.Println("binary.Read failed:", err)
+	size := binary.LittleEndian.Uint32(header)
+	if uint64(size) > uint64(c.maxFrameSize) {
+		err = &FrameError{Kind: ErrFrameTooLarge, Size: int(size), Max: c.maxFrameSize}
+		return
 	}
-	numBytes = int(numBytesUint32)
-	buf = make([]byte, 0)
-	for {
-		// log.Debugf("bytes: %d/%d",len(buf),numBytes)
-		tmp := make([]byte, numBytes-len(buf))
-		n, errRead := c.connection.Read(tmp)
-		if errRead != nil {
-			err = errRead
-			return
-		}
-		buf = append(buf, tmp[:n]...)
-		if numBytes == len(buf) {
-			break
+	numBytes = int(size)
+	c.connection.SetReadDeadline(deadline(c.timeouts.Read))
+	buf = getBuffer(numBytes)
+	if _, err = io.ReadFull(c.connection, buf); err != nil {
+		putBuffer(buf)
+		buf = nil
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = &FrameError{Kind: ErrMalformedFrame, Size: numBytes, Err: io.ErrUnexpectedEOF}
 		}
+		return
 	}
 	return
 }
 
+// deadline turns a timeout into a deadline from now, zero means none
+func deadline(d time.Duration) time.Time {
+	if d <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(d)
+}
+
 // Send a message
 func (c *Comm) Send(message []byte) (err error) {
 	_, err = c.Write(message)
@@ -0,0 +1,278 @@
+package comm_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miska12345/MiskaRFS/src/comm"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// bufConn is a net.Conn that reads from r and writes into w
+type bufConn struct {
+	net.Conn
+	r io.Reader
+	w bytes.Buffer
+}
+
+func (b *bufConn) Read(p []byte) (int, error)       { return b.r.Read(p) }
+func (b *bufConn) Write(p []byte) (int, error)      { return b.w.Write(p) }
+func (b *bufConn) SetDeadline(time.Time) error      { return nil }
+func (b *bufConn) SetReadDeadline(time.Time) error  { return nil }
+func (b *bufConn) SetWriteDeadline(time.Time) error { return nil }
+
+func frame(size uint32, body []byte) []byte {
+	header := make([]byte, 4)
+	binary.LittleEndian.PutUint32(header, size)
+	return append(header, body...)
+}
+
+func TestRoundTrip(t *testing.T) {
+	w := new(bufConn)
+	c := comm.New(w)
+	messages := [][]byte{
+		{},
+		[]byte("Hello, World!"),
+		bytes.Repeat([]byte{7}, 64*1024),
+		bytes.Repeat([]byte{9}, 200*1024),
+	}
+	for _, m := range messages {
+		assert.Nil(t, c.Send(m))
+	}
+
+	c = comm.New(&bufConn{r: bytes.NewReader(w.w.Bytes())})
+	for _, m := range messages {
+		data, err := c.Receive()
+		assert.Nil(t, err)
+		assert.Equal(t, m, data)
+		comm.Recycle(data)
+	}
+	_, err := c.Receive()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	c := comm.New(&bufConn{r: bytes.NewReader(frame(0xFFFFFFFF, nil))})
+	_, err := c.Receive()
+	assert.True(t, errors.Is(err, comm.ErrFrameTooLarge))
+
+	c = comm.New(&bufConn{r: bytes.NewReader(frame(11, []byte("Hello there")))})
+	c.SetMaxFrameSize(10)
+	_, err = c.Receive()
+	var frameErr *comm.FrameError
+	assert.True(t, errors.As(err, &frameErr))
+	assert.Equal(t, 11, frameErr.Size)
+	assert.Equal(t, 10, frameErr.Max)
+
+	w := new(bufConn)
+	c = comm.New(w)
+	c.SetMaxFrameSize(10)
+	assert.True(t, errors.Is(c.Send([]byte("Hello there")), comm.ErrFrameTooLarge))
+	assert.Equal(t, 0, w.w.Len())
+}
+
+func TestMalformedFrame(t *testing.T) {
+	for _, data := range [][]byte{
+		{1, 0},
+		frame(10, []byte("abc")),
+	} {
+		c := comm.New(&bufConn{r: bytes.NewReader(data)})
+		_, err := c.Receive()
+		assert.True(t, errors.Is(err, comm.ErrMalformedFrame), "%v", err)
+	}
+}
+
+func FuzzRead(f *testing.F) {
+	f.Add([]byte{})
+	f.Add(frame(0, nil))
+	f.Add(frame(5, []byte("hello")))
+	f.Add(frame(5, []byte("hel")))
+	f.Add(frame(0xFFFFFFFF, []byte("hello")))
+	f.Add(append(frame(1, []byte("a")), frame(2, []byte("bc"))...))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		const max = 1024
+		c := comm.New(&bufConn{r: bytes.NewReader(data)})
+		c.SetMaxFrameSize(max)
+		consumed := 0
+		for {
+			buf, numBytes, _, err := c.Read()
+			if err != nil {
+				var frameErr *comm.FrameError
+				if err != io.EOF && !errors.As(err, &frameErr) {
+					t.Fatalf("unexpected error %v", err)
+				}
+				return
+			}
+			if numBytes > max || len(buf) != numBytes {
+				t.Fatalf("got %d bytes for a frame of %d", len(buf), numBytes)
+			}
+			if !bytes.Equal(buf, data[consumed+4:consumed+4+numBytes]) {
+				t.Fatalf("frame does not match input")
+			}
+			consumed += 4 + numBytes
+			comm.Recycle(buf)
+		}
+	})
+}
+
+func TestTransports(t *testing.T) {
+	dir, err := ioutil.TempDir("", "comm")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	for name, tc := range map[string]struct {
+		transport comm.Transport
+		address   string
+	}{
+		"tcp":    {comm.TCP, "127.0.0.1:0"},
+		"unix":   {comm.Unix, filepath.Join(dir, "comm.sock")},
+		"memory": {comm.NewMemory(), "relay"},
+	} {
+		l, err := tc.transport.Listen(tc.address)
+		assert.Nil(t, err, name)
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c := comm.New(conn)
+			data, _ := c.Receive()
+			c.Send(data)
+		}()
+
+		c, err := comm.Dial(tc.transport, l.Addr().String())
+		assert.Nil(t, err, name)
+		assert.Nil(t, c.Send([]byte("Hello, World!")), name)
+		data, err := c.Receive()
+		assert.Nil(t, err, name)
+		assert.Equal(t, []byte("Hello, World!"), data, name)
+		c.Close()
+		l.Close()
+	}
+
+	_, err = comm.Dial(comm.NewMemory(), "nobody")
+	assert.NotNil(t, err)
+}
+
+func TestIdleTimeout(t *testing.T) {
+	memory := comm.NewMemory()
+	l, err := memory.Listen("relay")
+	assert.Nil(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		c := comm.New(conn)
+		// Keep the line busy for a while, then go quiet
+		for i := 0; i < 5; i++ {
+			c.Send([]byte{1})
+			time.Sleep(50 * time.Millisecond)
+		}
+	}()
+
+	c, err := comm.Dial(memory, "relay")
+	assert.Nil(t, err)
+	defer c.Close()
+	c.SetTimeouts(comm.Timeouts{Idle: 200 * time.Millisecond})
+	for i := 0; i < 5; i++ {
+		_, err = c.Receive()
+		assert.Nil(t, err)
+	}
+	_, err = c.Receive()
+	netErr, ok := err.(net.Error)
+	assert.True(t, ok)
+	assert.True(t, ok && netErr.Timeout())
+}
+
+func TestNewConnectionTLS(t *testing.T) {
+	cert, err := comm.SelfSignedCertificate("127.0.0.1")
+	assert.Nil(t, err)
+	l, err := comm.TLS(comm.TCP, &tls.Config{Certificates: []tls.Certificate{cert}}).Listen("127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c := comm.New(conn)
+			data, _ := c.Receive()
+			c.Send(data)
+		}
+	}()
+
+	// Unverified certificates are refused
+	_, err = comm.NewConnection(l.Addr().String(), comm.WithTLS(&tls.Config{}), comm.WithTimeout(time.Second))
+	assert.NotNil(t, err)
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	assert.Nil(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	c, err := comm.NewConnection(l.Addr().String(), comm.WithTLS(&tls.Config{RootCAs: pool}))
+	assert.Nil(t, err)
+	defer c.Close()
+	_, ok := c.Connection().(*tls.Conn)
+	assert.True(t, ok)
+	assert.Nil(t, c.Send([]byte("Hello, World!")))
+	data, err := c.Receive()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("Hello, World!"), data)
+}
+
+func TestWebSocketTLS(t *testing.T) {
+	cert, err := comm.SelfSignedCertificate("127.0.0.1")
+	assert.Nil(t, err)
+	srv := httptest.NewUnstartedServer(nil)
+	l := comm.NewWebSocketListener(srv.Listener.Addr())
+	srv.Config.Handler = l
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	srv.StartTLS()
+	defer srv.Close()
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c := comm.New(conn)
+			data, _ := c.Receive()
+			c.Send(data)
+		}
+	}()
+	address := "wss://" + srv.Listener.Addr().String() + "/"
+
+	// A private certificate isn't trusted by default
+	_, err = comm.Dial(comm.WebSocket, address, time.Second)
+	assert.NotNil(t, err)
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	assert.Nil(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	c, err := comm.Dial(comm.WebSocketTLS(&tls.Config{RootCAs: pool}), address, time.Second)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer c.Close()
+	assert.Nil(t, c.Send([]byte("Hello, World!")))
+	data, err := c.Receive()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("Hello, World!"), data)
+}
@@ -0,0 +1,74 @@
+package comm
+
+import (
+	stderrors "errors"
+	"fmt"
+	"sync"
+
+	"github.com/miska12345/MiskaRFS/src/models"
+)
+
+var (
+	// ErrFrameTooLarge is the kind of FrameError for frames above the size limit
+	ErrFrameTooLarge = stderrors.New("frame too large")
+	// ErrMalformedFrame is the kind of FrameError for frames cut short
+	ErrMalformedFrame = stderrors.New("malformed frame")
+)
+
+// FrameError reports a frame that could not be read or written
+type FrameError struct {
+	Kind error
+	Size int
+	Max  int
+	Err  error
+}
+
+func (e *FrameError) Error() string {
+	switch {
+	case e.Kind == ErrFrameTooLarge:
+		return fmt.Sprintf("%s: %d bytes exceeds limit of %d", e.Kind, e.Size, e.Max)
+	case e.Err != nil:
+		return fmt.Sprintf("%s: %s", e.Kind, e.Err)
+	}
+	return e.Kind.Error()
+}
+
+// Unwrap makes errors.Is(err, ErrFrameTooLarge) and friends work
+func (e *FrameError) Unwrap() error {
+	return e.Kind
+}
+
+// Frames up to TCP_BUFFER_SIZE are read into pooled buffers, larger ones are allocated
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, models.TCP_BUFFER_SIZE)
+		return &b
+	},
+}
+
+func getBuffer(n int) []byte {
+	if n > models.TCP_BUFFER_SIZE {
+		return make([]byte, n)
+	}
+	return (*bufferPool.Get().(*[]byte))[:n]
+}
+
+func putBuffer(b []byte) {
+	if cap(b) != models.TCP_BUFFER_SIZE {
+		return
+	}
+	b = b[:cap(b)]
+	bufferPool.Put(&b)
+}
+
+// Buffer returns a buffer of n bytes, from the pool if it fits, for callers framing their own data.
+// Hand it back with Recycle.
+func Buffer(n int) []byte {
+	return getBuffer(n)
+}
+
+// Recycle hands a buffer returned by Read or Receive back to the pool.
+// The buffer must not be used afterwards.
+func Recycle(b []byte) {
+	putBuffer(b)
+}
@@ -0,0 +1,152 @@
+package comm
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"time"
+)
+
+// TLS wraps the connections of another transport in TLS.
+// When config has no ServerName the host part of the dialed address is verified.
+func TLS(t Transport, config *tls.Config) Transport {
+	return &tlsTransport{transport: t, config: config}
+}
+
+type tlsTransport struct {
+	transport Transport
+	config    *tls.Config
+}
+
+func (t *tlsTransport) Dial(address string, timeout time.Duration) (net.Conn, error) {
+	conn, err := t.transport.Dial(address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	config := t.config.Clone()
+	if config.ServerName == "" {
+		config.ServerName = address
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			config.ServerName = host
+		}
+	}
+	tlsConn := tls.Client(conn, config)
+	tlsConn.SetDeadline(time.Now().Add(timeout))
+	if err = tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+func (t *tlsTransport) Listen(address string) (net.Listener, error) {
+	l, err := t.transport.Listen(address)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(l, t.config), nil
+}
+
+// WithTLS makes NewConnection secure the connection with TLS, see TLS for how the server is verified
+func WithTLS(config *tls.Config) ConnectionOption {
+	return func(o *connectionOptions) {
+		o.tls = config
+	}
+}
+
+// ServerTLSConfig loads the certificate a server presents.
+// If clientCAFile is given, clients must present a certificate signed by it.
+func ServerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile != "" {
+		config.ClientCAs, err = loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// ClientTLSConfig trusts the CA in caFile, or the system roots if empty,
+// and presents the client certificate in certFile and keyFile if given
+func ClientTLSConfig(caFile, certFile, keyFile string) (config *tls.Config, err error) {
+	config = &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		config.RootCAs, err = loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// SelfSignedCertificate generates a throwaway certificate for hosts, meant for development only.
+// Clients have to skip verification or pin it, e.g. with InsecureSkipVerify.
+func SelfSignedCertificate(hosts ...string) (cert tls.Certificate, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"MiskaRFS development"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return
+	}
+	cert.Certificate = [][]byte{der}
+	cert.PrivateKey = key
+	return
+}
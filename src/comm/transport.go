@@ -0,0 +1,128 @@
+package comm
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Transport dials and listens for the connections a Comm runs on
+type Transport interface {
+	Dial(address string, timeout time.Duration) (net.Conn, error)
+	Listen(address string) (net.Listener, error)
+}
+
+var (
+	// TCP is the default transport
+	TCP Transport = netTransport("tcp")
+	// Unix runs over unix domain sockets, address is the socket path
+	Unix Transport = netTransport("unix")
+)
+
+type netTransport string
+
+func (n netTransport) Dial(address string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout(string(n), address, timeout)
+}
+
+func (n netTransport) Listen(address string) (net.Listener, error) {
+	return net.Listen(string(n), address)
+}
+
+// Memory is an in-process transport built on net.Pipe.
+// Relay, host and client can share one to talk without opening ports.
+type Memory struct {
+	listeners map[string]*memoryListener
+	sync.Mutex
+}
+
+// NewMemory returns an empty in-memory network
+func NewMemory() *Memory {
+	return &Memory{listeners: make(map[string]*memoryListener)}
+}
+
+// Listen claims address on the in-memory network
+func (m *Memory) Listen(address string) (net.Listener, error) {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.listeners[address]; ok {
+		return nil, fmt.Errorf("memory address %s already in use", address)
+	}
+	l := &memoryListener{
+		memory: m,
+		addr:   memoryAddr(address),
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+	m.listeners[address] = l
+	return l, nil
+}
+
+// Dial connects to a listener on the in-memory network
+func (m *Memory) Dial(address string, timeout time.Duration) (net.Conn, error) {
+	m.Lock()
+	l, ok := m.listeners[address]
+	m.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("dial memory %s: connection refused", address)
+	}
+
+	local, remote := net.Pipe()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case l.conns <- remote:
+		return local, nil
+	case <-l.closed:
+		err := fmt.Errorf("dial memory %s: connection refused", address)
+		local.Close()
+		remote.Close()
+		return nil, err
+	case <-timer.C:
+		local.Close()
+		remote.Close()
+		return nil, fmt.Errorf("dial memory %s: timeout", address)
+	}
+}
+
+type memoryListener struct {
+	memory *Memory
+	addr   memoryAddr
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (l *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, fmt.Errorf("accept memory %s: listener closed", l.addr)
+	}
+}
+
+func (l *memoryListener) Close() error {
+	l.once.Do(func() {
+		l.memory.Lock()
+		delete(l.memory.listeners, string(l.addr))
+		l.memory.Unlock()
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *memoryListener) Addr() net.Addr {
+	return l.addr
+}
+
+type memoryAddr string
+
+func (a memoryAddr) Network() string {
+	return "memory"
+}
+
+func (a memoryAddr) String() string {
+	return string(a)
+}
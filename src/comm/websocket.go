@@ -0,0 +1,258 @@
+package comm
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/websocket"
+)
+
+// WebSocket carries the same frames inside binary WebSocket messages so they pass through HTTP proxies.
+// Addresses are ws:// or wss:// URLs, HTTPS_PROXY and friends are honoured when dialing.
+// wss:// servers are verified against the system's roots, see WebSocketTLS for others.
+var WebSocket Transport = webSocketTransport{}
+
+// WebSocketTLS is WebSocket dialing wss:// addresses with config, e.g. to trust a private CA.
+// When config has no ServerName the host of the dialed URL is verified.
+func WebSocketTLS(config *tls.Config) Transport {
+	return webSocketTransport{tls: config}
+}
+
+// TransportFor picks WebSocket for ws:// and wss:// addresses and TCP for everything else
+func TransportFor(address string) Transport {
+	if strings.HasPrefix(address, "ws://") || strings.HasPrefix(address, "wss://") {
+		return WebSocket
+	}
+	return TCP
+}
+
+type webSocketTransport struct {
+	// tls is what wss:// addresses are dialed with, nil for the defaults
+	tls *tls.Config
+}
+
+func (t webSocketTransport) Dial(address string, timeout time.Duration) (net.Conn, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	origin := &url.URL{Scheme: "http", Host: u.Host}
+	if u.Scheme == "wss" {
+		origin.Scheme = "https"
+	}
+	config, err := websocket.NewConfig(address, origin.String())
+	if err != nil {
+		return nil, err
+	}
+
+	hostPort := u.Host
+	if u.Port() == "" {
+		hostPort = net.JoinHostPort(u.Hostname(), map[string]string{"ws": "80", "wss": "443"}[u.Scheme])
+	}
+	proxy, err := http.ProxyFromEnvironment(&http.Request{URL: &url.URL{Scheme: origin.Scheme, Host: u.Host}})
+	if err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn
+	if proxy != nil {
+		conn, err = net.DialTimeout("tcp", proxy.Host, timeout)
+	} else {
+		conn, err = net.DialTimeout("tcp", hostPort, timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	if proxy != nil {
+		if err = connectThroughProxy(conn, proxy, hostPort); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if u.Scheme == "wss" {
+		tlsConfig := &tls.Config{}
+		if t.tls != nil {
+			tlsConfig = t.tls.Clone()
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = u.Hostname()
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err = tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "websocket handshake with "+address)
+	}
+	conn.SetDeadline(time.Time{})
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
+}
+
+// connectThroughProxy asks an HTTP proxy to tunnel conn to hostPort
+func connectThroughProxy(conn net.Conn, proxy *url.URL, hostPort string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: hostPort},
+		Host:   hostPort,
+		Header: make(http.Header),
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		r := &http.Request{Header: make(http.Header)}
+		r.SetBasicAuth(proxy.User.Username(), password)
+		req.Header.Set("Proxy-Authorization", r.Header.Get("Authorization"))
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("proxy %s refused to connect to %s: %s", proxy.Host, hostPort, res.Status)
+	}
+	return nil
+}
+
+// Listen serves WebSocket connections at the host and path of a ws:// URL, e.g. ws://:8081/relay
+func (webSocketTransport) Listen(address string) (net.Listener, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ws" {
+		return nil, fmt.Errorf("can only listen on ws:// addresses, put wss:// behind a TLS terminating proxy")
+	}
+	ln, err := net.Listen("tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	l := NewWebSocketListener(ln.Addr())
+	mux := http.NewServeMux()
+	mux.Handle(path, l)
+	srv := &http.Server{Handler: mux}
+	l.onClose = func() { srv.Close() }
+	go srv.Serve(ln)
+	return l, nil
+}
+
+// WebSocketListener is both a net.Listener and the http.Handler that feeds it.
+// Mount it on any HTTP server, e.g. next to other handlers or in an httptest.Server.
+type WebSocketListener struct {
+	addr    net.Addr
+	conns   chan net.Conn
+	closed  chan struct{}
+	once    sync.Once
+	onClose func()
+}
+
+// NewWebSocketListener returns a listener reporting addr as its address
+func NewWebSocketListener(addr net.Addr) *WebSocketListener {
+	return &WebSocketListener{
+		addr:   addr,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// ServeHTTP upgrades the request and hands the connection to Accept
+func (l *WebSocketListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	websocket.Server{Handler: func(ws *websocket.Conn) {
+		ws.PayloadType = websocket.BinaryFrame
+		c := &webSocketConn{
+			Conn:   ws,
+			local:  l.addr,
+			remote: webSocketAddr(r.RemoteAddr),
+			closed: make(chan struct{}),
+		}
+		select {
+		case l.conns <- c:
+		case <-l.closed:
+			return
+		}
+		// The connection is gone as soon as this handler returns
+		select {
+		case <-c.closed:
+		case <-l.closed:
+		}
+	}}.ServeHTTP(w, r)
+}
+
+// Accept waits for the next WebSocket connection
+func (l *WebSocketListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, fmt.Errorf("accept websocket %s: listener closed", l.addr)
+	}
+}
+
+// Close stops accepting connections and drops open ones
+func (l *WebSocketListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+		if l.onClose != nil {
+			l.onClose()
+		}
+	})
+	return nil
+}
+
+// Addr returns the address given to NewWebSocketListener
+func (l *WebSocketListener) Addr() net.Addr {
+	return l.addr
+}
+
+// webSocketConn reports the addresses of the underlying HTTP connection instead of the origin
+type webSocketConn struct {
+	*websocket.Conn
+	local  net.Addr
+	remote net.Addr
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (c *webSocketConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *webSocketConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *webSocketConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+type webSocketAddr string
+
+func (a webSocketAddr) Network() string {
+	return "websocket"
+}
+
+func (a webSocketAddr) String() string {
+	return string(a)
+}
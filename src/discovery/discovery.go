@@ -0,0 +1,194 @@
+// Package discovery finds hosts on the local network without a relay.
+// Hosts multicast who they are and where they listen, clients browse for them.
+package discovery
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/miska12345/MiskaRFS/src/comm"
+	log "github.com/miska12345/MiskaRFS/src/logger"
+	"github.com/pkg/errors"
+	"golang.org/x/net/ipv4"
+)
+
+// DefaultGroup is the multicast group and port hosts announce themselves on
+const DefaultGroup = "239.255.77.77:7757"
+
+// DefaultInterval is how often a host announces itself
+const DefaultInterval = time.Second
+
+// announcePrefix starts every announcement so other traffic on the group is ignored
+var announcePrefix = []byte("miskarfs-announce:")
+
+// Announcements are small, anything bigger isn't one
+const maxAnnouncement = 1024
+
+// Service is a host found on the local network
+type Service struct {
+	Name string
+	// Address is where the host accepts clients
+	Address string
+	// Fingerprint of the host identity, to check against the pinned one
+	Fingerprint string
+}
+
+// announcement is what goes on the wire, the address is wherever it came from
+type announcement struct {
+	Name        string
+	Port        int
+	Fingerprint string
+}
+
+// Announcer keeps announcing a host until closed
+type Announcer struct {
+	conn  *net.UDPConn
+	done  chan struct{}
+	close sync.Once
+}
+
+// Config picks where announcements go, zero values use the defaults
+type Config struct {
+	Group string
+	// Interface to multicast on, the system picks one if nil
+	Interface *net.Interface
+	// Interval between announcements
+	Interval time.Duration
+}
+
+func (config *Config) group() (*net.UDPAddr, error) {
+	group := DefaultGroup
+	if config != nil && config.Group != "" {
+		group = config.Group
+	}
+	return net.ResolveUDPAddr("udp4", group)
+}
+
+// Announce tells the local network that host name, with the given identity fingerprint, accepts clients on port
+func Announce(config *Config, name string, port int, fingerprint string) (*Announcer, error) {
+	if config == nil {
+		config = &Config{}
+	}
+	group, err := config.group()
+	if err != nil {
+		return nil, err
+	}
+	interval := config.Interval
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	bys, err := json.Marshal(announcement{Name: name, Port: port, Fingerprint: fingerprint})
+	if err != nil {
+		return nil, err
+	}
+	bys = append(append([]byte{}, announcePrefix...), bys...)
+
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	pc := ipv4.NewPacketConn(conn)
+	if config.Interface != nil {
+		if err = pc.SetMulticastInterface(config.Interface); err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "Could not multicast on "+config.Interface.Name)
+		}
+	}
+	// Browsers on this machine should see it too
+	pc.SetMulticastLoopback(true)
+
+	a := &Announcer{conn: conn, done: make(chan struct{})}
+	go a.announce(group, bys, interval)
+	return a, nil
+}
+
+func (a *Announcer) announce(group *net.UDPAddr, message []byte, interval time.Duration) {
+	// Each announcement is one comm frame in one datagram
+	frame := make([]byte, comm.HeaderSize+len(message))
+	binary.LittleEndian.PutUint32(frame, uint32(len(message)))
+	copy(frame[comm.HeaderSize:], message)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := a.conn.WriteTo(frame, group); err != nil {
+			log.Debugf("Could not announce: %s", err)
+		}
+		select {
+		case <-a.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close stops announcing, closing again does nothing
+func (a *Announcer) Close() (err error) {
+	a.close.Do(func() {
+		close(a.done)
+		err = a.conn.Close()
+	})
+	return
+}
+
+// Browse listens for hosts announcing themselves for timeout and returns each one found once
+func Browse(config *Config, timeout time.Duration) ([]Service, error) {
+	if config == nil {
+		config = &Config{}
+	}
+	group, err := config.group()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenMulticastUDP("udp4", config.Interface, group)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(timeout))
+
+	services := []Service{}
+	seen := make(map[Service]bool)
+	buf := make([]byte, maxAnnouncement)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return services, nil
+			}
+			return services, err
+		}
+		service, ok := parseAnnouncement(buf[:n], from)
+		if !ok || seen[service] {
+			continue
+		}
+		seen[service] = true
+		services = append(services, service)
+	}
+}
+
+// parseAnnouncement reads a datagram from a host, ok is false if it isn't an announcement
+func parseAnnouncement(datagram []byte, from *net.UDPAddr) (service Service, ok bool) {
+	if len(datagram) < comm.HeaderSize {
+		return
+	}
+	size := int(binary.LittleEndian.Uint32(datagram))
+	message := datagram[comm.HeaderSize:]
+	if size != len(message) || !bytes.HasPrefix(message, announcePrefix) {
+		return
+	}
+	var a announcement
+	if err := json.Unmarshal(message[len(announcePrefix):], &a); err != nil || a.Port <= 0 {
+		return
+	}
+	return Service{
+		Name:        a.Name,
+		Address:     net.JoinHostPort(from.IP.String(), strconv.Itoa(a.Port)),
+		Fingerprint: a.Fingerprint,
+	}, true
+}
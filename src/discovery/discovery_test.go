@@ -0,0 +1,52 @@
+package discovery_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miska12345/MiskaRFS/src/discovery"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func loopback(t *testing.T) *discovery.Config {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip("no loopback interface")
+	}
+	return &discovery.Config{
+		Group:     "239.255.77.78:7758",
+		Interface: lo,
+		Interval:  50 * time.Millisecond,
+	}
+}
+
+func TestBrowse(t *testing.T) {
+	config := loopback(t)
+	a, err := discovery.Announce(config, "pc-admin", 4000, "SHA256:abc")
+	assert.Nil(t, err)
+	defer a.Close()
+
+	// Not an announcement, browsers should skip it
+	conn, err := net.Dial("udp4", config.Group)
+	assert.Nil(t, err)
+	conn.Write([]byte("hello"))
+	conn.Close()
+
+	services, err := discovery.Browse(config, 300*time.Millisecond)
+	assert.Nil(t, err)
+	if assert.Len(t, services, 1) {
+		assert.Equal(t, "pc-admin", services[0].Name)
+		assert.Equal(t, "SHA256:abc", services[0].Fingerprint)
+		_, port, err := net.SplitHostPort(services[0].Address)
+		assert.Nil(t, err)
+		assert.Equal(t, "4000", port)
+	}
+
+	// Gone once closed
+	a.Close()
+	services, err = discovery.Browse(config, 200*time.Millisecond)
+	assert.Nil(t, err)
+	assert.Empty(t, services)
+}
@@ -0,0 +1,261 @@
+package fs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	msg "github.com/miska12345/MiskaRFS/src/message"
+)
+
+// FindMatch is a path find turned up
+type FindMatch struct {
+	Path string
+	// Type is f for files, d for directories and l for symlinks
+	Type    string
+	Size    int64
+	ModTime time.Time
+}
+
+// FindSummary is the last part of a find
+type FindSummary struct {
+	Matches   int
+	Cancelled bool
+}
+
+// findQuery is what find looks for, zero values match everything.
+// maxSize and maxDepth are -1 when unset.
+type findQuery struct {
+	root     string
+	name     string
+	kind     string
+	minSize  int64
+	maxSize  int64
+	newer    time.Time
+	older    time.Time
+	maxDepth int
+}
+
+func (q *findQuery) match(info os.FileInfo) bool {
+	if q.name != "" {
+		if ok, _ := filepath.Match(q.name, info.Name()); !ok {
+			return false
+		}
+	}
+	if q.kind != "" && q.kind != fileType(info) {
+		return false
+	}
+	if info.Size() < q.minSize || (q.maxSize >= 0 && info.Size() > q.maxSize) {
+		return false
+	}
+	if !q.newer.IsZero() && info.ModTime().Before(q.newer) {
+		return false
+	}
+	if !q.older.IsZero() && info.ModTime().After(q.older) {
+		return false
+	}
+	return true
+}
+
+func fileType(info os.FileInfo) string {
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		return "l"
+	case info.IsDir():
+		return "d"
+	}
+	return "f"
+}
+
+// parseFind reads: [path] [-name glob] [-type f|d|l] [-size +N|-N|N]... [-newer T] [-older T] [-maxdepth N].
+// Sizes are more than, less than or exactly N bytes and take k, M and G suffixes,
+// times are durations ago like 24h or dates like 2006-01-02.
+func parseFind(args []string) (q findQuery, err error) {
+	q.root = "."
+	q.maxSize = -1
+	q.maxDepth = -1
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "" {
+			continue
+		}
+		if !strings.HasPrefix(arg, "-") {
+			if i != 0 {
+				return q, fmt.Errorf("Unexpected %s", arg)
+			}
+			q.root = arg
+			continue
+		}
+		if i+1 == len(args) {
+			return q, fmt.Errorf("%s needs a value", arg)
+		}
+		i++
+		value := args[i]
+		switch arg {
+		case "-name":
+			if _, err = filepath.Match(value, ""); err != nil {
+				return
+			}
+			q.name = value
+		case "-type":
+			if value != "f" && value != "d" && value != "l" {
+				return q, fmt.Errorf("-type is f, d or l")
+			}
+			q.kind = value
+		case "-size":
+			var size int64
+			if size, err = parseSize(strings.TrimLeft(value, "+-")); err != nil {
+				return
+			}
+			// The limits are kept inclusive
+			switch value[0] {
+			case '+':
+				q.minSize = size + 1
+			case '-':
+				if size == 0 {
+					return q, fmt.Errorf("Nothing is smaller than -size %s", value)
+				}
+				q.maxSize = size - 1
+			default:
+				q.minSize, q.maxSize = size, size
+			}
+		case "-newer":
+			if q.newer, err = parseTime(value); err != nil {
+				return
+			}
+		case "-older":
+			if q.older, err = parseTime(value); err != nil {
+				return
+			}
+		case "-maxdepth":
+			if q.maxDepth, err = strconv.Atoi(value); err != nil || q.maxDepth < 0 {
+				return q, fmt.Errorf("-maxdepth is a number of levels")
+			}
+		default:
+			return q, fmt.Errorf("Unknown option %s", arg)
+		}
+	}
+	return q, nil
+}
+
+func parseSize(s string) (int64, error) {
+	unit := int64(1)
+	switch {
+	case strings.HasSuffix(s, "k"):
+		unit = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		unit = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		unit = 1 << 30
+	}
+	if unit > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Bad size %s", s)
+	}
+	return n * unit, nil
+}
+
+func parseTime(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Bad time %s, use a duration like 24h or a date like 2006-01-02", s)
+}
+
+// Find walks from the current directory, or the path given, sending matches in batches as it goes
+// until the walk is done or cancel is closed. See parseFind for the options.
+func (fs *FSConfig) Find(send func(*msg.Message) error, cancel <-chan struct{}, args ...string) *msg.Message {
+	q, err := parseFind(args)
+	if err != nil {
+		return msg.New(msg.TYPE_ERROR, err.Error())
+	}
+	root, err := fs.resolve(q.root)
+	if err != nil {
+		return msg.New(msg.TYPE_ERROR, err.Error())
+	}
+	info, err := os.Lstat(root)
+	if err != nil {
+		return msg.New(msg.TYPE_ERROR, ERR_NOT_FOUND)
+	}
+
+	base, err := fs.root()
+	if err != nil {
+		return msg.New(msg.TYPE_ERROR, err.Error())
+	}
+	f := &finder{fs: fs, base: base, query: &q, cancel: cancel, results: newBatcher(send)}
+	err = f.walk(root, info, 0)
+	if err == nil {
+		err = f.results.flush()
+	}
+	switch err {
+	case nil:
+	case errCancelled:
+		f.summary.Cancelled = true
+	default:
+		return msg.New(msg.TYPE_ERROR, err.Error())
+	}
+	bys, err := json.Marshal(f.summary)
+	if err != nil {
+		return msg.New(msg.TYPE_ERROR, err.Error())
+	}
+	return msg.New(msg.TYPE_RESPONSE, string(bys))
+}
+
+type finder struct {
+	fs *FSConfig
+	// base is baseDir as fs.root has it
+	base    string
+	query   *findQuery
+	cancel  <-chan struct{}
+	results *batcher
+	summary FindSummary
+}
+
+// walk visits p and what is under it, without following symlinks or going into invisible directories
+func (f *finder) walk(p string, info os.FileInfo, depth int) error {
+	if cancelled(f.cancel) {
+		return errCancelled
+	}
+	if f.query.match(info) {
+		f.summary.Matches++
+		err := f.results.add(FindMatch{
+			Path:    f.fs.display(p),
+			Type:    fileType(info),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if !info.IsDir() || depth == f.query.maxDepth {
+		return nil
+	}
+	list, err := ioutil.ReadDir(p)
+	if err != nil {
+		// Unreadable directories are skipped like invisible ones
+		return nil
+	}
+	for _, child := range list {
+		if f.fs.invisible(f.base, filepath.Join(p, child.Name()), child.IsDir()) {
+			continue
+		}
+		if err := f.walk(filepath.Join(p, child.Name()), child, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
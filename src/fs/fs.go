@@ -2,12 +2,14 @@
 package fs
 
 import (
+	"crypto/rand"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	msg "github.com/miska12345/MiskaRFS/src/message"
@@ -17,14 +19,33 @@ const PERM_DENIED = "PERMISSION DENIED"
 
 type FSConfig struct {
 	baseDir        string
-	invisibleFiles map[string]bool
+	invisibleFiles rules
 	readOnly       bool
-	lastAccessed   time.Time
-	currentDir     string
+	// secret signs the tokens that confirm a recursive remove
+	secret []byte
+	// cwd is where relative paths start, each Session has its own
+	cwd *workingDir
+	*shared
 }
 
+// shared is what every Session of a file system has in common
+type shared struct {
+	lastAccessed time.Time
+	trashPolicy  TrashPolicy
+	trashLock    sync.Mutex
+	// purging is closed to stop applying trashPolicy in the background
+	purging  chan struct{}
+	dirCache dirCache
+}
+
+type workingDir struct {
+	dir string
+	sync.Mutex
+}
+
+// Init sets up the file system at baseDir, hiding what the invisibleFiles patterns match, see rules
 func Init(baseDir string, invisibleFiles []string, readOnly bool) (fsc *FSConfig, err error) {
-	fsc = new(FSConfig)
+	fsc = &FSConfig{shared: new(shared)}
 	fsc.baseDir = baseDir
 
 	_, err = ioutil.ReadDir(fsc.baseDir)
@@ -32,21 +53,55 @@ func Init(baseDir string, invisibleFiles []string, readOnly bool) (fsc *FSConfig
 		return nil, err
 	}
 
-	fsc.invisibleFiles = make(map[string]bool)
-	for _, v := range invisibleFiles {
-		fsc.invisibleFiles[v] = true
+	// Last so that no pattern makes the trash visible
+	patterns := append(append([]string{}, invisibleFiles...), "/"+TRASH_DIR)
+	if fsc.invisibleFiles, err = parseRules(patterns); err != nil {
+		return nil, err
+	}
+
+	fsc.secret = make([]byte, 32)
+	if _, err = rand.Read(fsc.secret); err != nil {
+		return nil, err
 	}
 
 	fsc.readOnly = readOnly
-	fsc.currentDir = baseDir
+	fsc.cwd = &workingDir{dir: baseDir}
 	fsc.lastAccessed = time.Now()
 	return
 }
 
+// Session returns the file system with a current directory of its own, starting at baseDir,
+// so that a client changing directory doesn't move anyone else
+func (fs *FSConfig) Session() *FSConfig {
+	s := *fs
+	s.cwd = &workingDir{dir: fs.baseDir}
+	return &s
+}
+
+func (fs *FSConfig) currentDir() string {
+	fs.cwd.Lock()
+	defer fs.cwd.Unlock()
+	return fs.cwd.dir
+}
+
+func (fs *FSConfig) setCurrentDir(dir string) {
+	fs.cwd.Lock()
+	fs.cwd.dir = dir
+	fs.cwd.Unlock()
+}
+
 // ListFiles lists all the visible files under current directory
 func (fs *FSConfig) ListFiles(args ...string) (fres *msg.Message) {
 	var buf strings.Builder
-	f, err := os.Open(fs.currentDir)
+	root, err := fs.root()
+	if err != nil {
+		return msg.New(msg.TYPE_ERROR, err.Error())
+	}
+	dir, err := fs.resolve(".")
+	if err != nil {
+		return msg.New(msg.TYPE_ERROR, err.Error())
+	}
+	f, err := os.Open(dir)
 	if err != nil {
 		return msg.New(msg.TYPE_ERROR, err.Error())
 	}
@@ -63,12 +118,12 @@ func (fs *FSConfig) ListFiles(args ...string) (fres *msg.Message) {
 		}
 		return list[i].Name() < list[j].Name()
 	})
-	buf.WriteString(fmt.Sprintf("\n\tDirectory: %s\n\n", fs.currentDir))
+	buf.WriteString(fmt.Sprintf("\n\tDirectory: %s\n\n", fs.display(dir)))
 	for _, v := range list {
 		fname := v.Name()
 
 		// File filter
-		if _, invisible := fs.invisibleFiles[fname]; invisible {
+		if fs.invisible(root, filepath.Join(dir, fname), v.IsDir()) {
 			continue
 		}
 		if v.IsDir() {
@@ -79,40 +134,42 @@ func (fs *FSConfig) ListFiles(args ...string) (fres *msg.Message) {
 	return msg.New(msg.TYPE_RESPONSE, buf.String())
 }
 
-// CD will change the current directory
+// CD will change the current directory, to somewhere visible in baseDir
 func (fs *FSConfig) CD(args ...string) *msg.Message {
 	if len(args) == 0 {
-		return msg.New(msg.TYPE_RESPONSE, fs.currentDir)
+		// The current directory as clients see it, where it is on the host is none of their business
+		args = []string{"."}
 	}
-	if _, err := os.Stat(fs.currentDir); os.IsNotExist(err) {
+	full, err := fs.resolve(args[0])
+	if err != nil {
 		return msg.New(msg.TYPE_ERROR, err.Error())
 	}
-	fs.currentDir = args[0]
-	return msg.New(msg.TYPE_RESPONSE, fs.currentDir)
+	info, err := os.Stat(full)
+	if err != nil {
+		return msg.New(msg.TYPE_ERROR, ERR_NOT_FOUND)
+	}
+	if !info.IsDir() {
+		return msg.New(msg.TYPE_ERROR, fmt.Sprintf("%s is not a directory", args[0]))
+	}
+	fs.setCurrentDir(full)
+	return msg.New(msg.TYPE_RESPONSE, fs.display(full))
 }
 
 // Mkdir will create a new directory
 func (fs *FSConfig) Mkdir(args ...string) *msg.Message {
 	for _, v := range args {
-		err := os.Mkdir(filepath.Join(fs.currentDir, v), os.ModeDir)
+		full, err := fs.resolve(v)
 		if err != nil {
 			return msg.New(msg.TYPE_ERROR, err.Error())
 		}
-	}
-	return fs.ListFiles()
-}
-
-// Remove will remove the specified files
-func (fs *FSConfig) Remove(args ...string) *msg.Message {
-	if fs.readOnly {
-		return msg.New(msg.TYPE_ERROR, PERM_DENIED)
-	}
-	for _, v := range args {
-		// Skip all the invisible files
-		if _, inv := fs.invisibleFiles[v]; inv {
-			continue
+		// resolve can't tell that patterns for directories only will hide it
+		if root, err := fs.root(); err != nil || fs.invisible(root, full, true) {
+			return msg.New(msg.TYPE_ERROR, PERM_DENIED)
+		}
+		err = os.Mkdir(full, os.ModeDir)
+		if err != nil {
+			return msg.New(msg.TYPE_ERROR, err.Error())
 		}
-		os.Remove(filepath.Join(fs.currentDir, v))
 	}
 	return fs.ListFiles()
 }
@@ -0,0 +1,778 @@
+package fs_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miska12345/MiskaRFS/src/fs"
+	msg "github.com/miska12345/MiskaRFS/src/message"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// setup makes a baseDir holding a/one.txt, a/b/two.txt and a/secret, with secret invisible
+func setup(t *testing.T) (string, *fs.FSConfig) {
+	dir, err := ioutil.TempDir("", "fs")
+	assert.Nil(t, err)
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "a", "b"), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "a", "one.txt"), []byte("one"), 0640))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "a", "b", "two.txt"), []byte("two"), 0600))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "a", "secret"), []byte("shh"), 0600))
+	config, err := fs.Init(dir, []string{"secret"}, false)
+	assert.Nil(t, err)
+	return dir, config
+}
+
+// decode checks that res is a response and reads the JSON in it into v
+func decode(t *testing.T, res *msg.Message, v interface{}) bool {
+	if !assert.Equal(t, msg.TYPE_RESPONSE, res.Type, res.Msg) {
+		return false
+	}
+	return assert.Nil(t, json.Unmarshal([]byte(res.Msg), v))
+}
+
+func TestCopy(t *testing.T) {
+	dir, config := setup(t)
+	defer os.RemoveAll(dir)
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	assert.Nil(t, os.Chtimes(filepath.Join(dir, "a", "one.txt"), old, old))
+
+	s := new(fs.TransferSummary)
+	decode(t, config.Copy("-r", "a", "c"), s)
+	assert.Equal(t, "copy", s.Op)
+	assert.Equal(t, 2, s.Files)
+	assert.Equal(t, 2, s.Dirs)
+	assert.Equal(t, int64(6), s.Bytes)
+
+	info, err := os.Stat(filepath.Join(dir, "c", "one.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+	assert.True(t, info.ModTime().Equal(old))
+	data, err := ioutil.ReadFile(filepath.Join(dir, "c", "b", "two.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "two", string(data))
+	// Invisible files stay where they are
+	_, err = os.Stat(filepath.Join(dir, "c", "secret"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Copying again clashes unless told what to do
+	assert.Equal(t, msg.TYPE_ERROR, config.Copy("a/one.txt", "c").Type)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "a", "one.txt"), []byte("uno"), 0640))
+	s = new(fs.TransferSummary)
+	decode(t, config.Copy("-n", "a/one.txt", "c"), s)
+	assert.Equal(t, 1, s.Skipped)
+	s = new(fs.TransferSummary)
+	decode(t, config.Copy("-f", "a/one.txt", "c"), s)
+	assert.Equal(t, 1, s.Files)
+	data, err = ioutil.ReadFile(filepath.Join(dir, "c", "one.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "uno", string(data))
+
+	// The sandbox holds for both ends
+	assert.Equal(t, fs.PERM_DENIED, config.Copy("../..", "x").Msg)
+	assert.Equal(t, fs.PERM_DENIED, config.Copy("a/one.txt", "../escaped").Msg)
+	assert.Equal(t, fs.ERR_NOT_FOUND, config.Copy("a/secret", "c").Msg)
+	assert.Equal(t, msg.TYPE_ERROR, config.Copy("a", "a/b").Type)
+}
+
+func TestMove(t *testing.T) {
+	dir, config := setup(t)
+	defer os.RemoveAll(dir)
+
+	s := new(fs.TransferSummary)
+	decode(t, config.Move("a/b", "/moved"), s)
+	assert.Equal(t, "move", s.Op)
+	assert.Equal(t, 1, s.Files)
+	assert.Equal(t, fs.TransferEntry{From: "/a/b/two.txt", To: "/moved/two.txt", Size: 3}, s.Entries[1])
+	_, err := os.Stat(filepath.Join(dir, "moved", "two.txt"))
+	assert.Nil(t, err)
+
+	// Several sources go into a directory
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "three.txt"), []byte("3"), 0644))
+	s = new(fs.TransferSummary)
+	decode(t, config.Move("a/one.txt", "three.txt", "moved"), s)
+	assert.Equal(t, 2, s.Files)
+	_, err = os.Stat(filepath.Join(dir, "moved", "three.txt"))
+	assert.Nil(t, err)
+
+	// A directory with invisible files in it stays put
+	assert.Equal(t, msg.TYPE_ERROR, config.Move("a", "elsewhere").Type)
+	_, err = os.Stat(filepath.Join(dir, "a", "secret"))
+	assert.Nil(t, err)
+
+	// Nor is one overwritten, the trash would take its invisible files
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "x", "a"), 0755))
+	res := config.Move("-f", "x/a", "/")
+	assert.Equal(t, msg.TYPE_ERROR, res.Type)
+	assert.Contains(t, res.Msg, fs.PERM_DENIED)
+	_, err = os.Stat(filepath.Join(dir, "a", "secret"))
+	assert.Nil(t, err)
+	var items []fs.TrashItem
+	decode(t, config.Trash("ls"), &items)
+	assert.Empty(t, items)
+
+	readOnly, err := fs.Init(dir, nil, true)
+	assert.Nil(t, err)
+	assert.Equal(t, fs.PERM_DENIED, readOnly.Move("moved", "back").Msg)
+}
+
+func TestRemove(t *testing.T) {
+	dir, config := setup(t)
+	defer os.RemoveAll(dir)
+
+	s := new(fs.RemoveSummary)
+	decode(t, config.Remove("a/one.txt", "a/b", "missing", "/"), s)
+	assert.Equal(t, []fs.RemoveResult{
+		{Path: "/a/one.txt", Entries: 1, Removed: true},
+		{Path: "/a/b", Dir: true, Entries: 1, Error: "Directory is not empty, remove it with -r"},
+		{Path: "missing", Error: fs.ERR_NOT_FOUND},
+		{Path: "/", Error: fs.PERM_DENIED},
+	}, s.Results)
+
+	// Recursive removes go through a dry run first
+	assert.Equal(t, msg.TYPE_ERROR, config.Remove("-r", "a/b").Type)
+	s = new(fs.RemoveSummary)
+	decode(t, config.Remove("-r", "--dry-run", "a/b"), s)
+	assert.True(t, s.DryRun)
+	assert.Equal(t, []fs.RemoveResult{{Path: "/a/b", Dir: true, Entries: 2}}, s.Results)
+	_, err := os.Stat(filepath.Join(dir, "a", "b"))
+	assert.Nil(t, err)
+
+	// The token is only good for what the dry run saw
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "a", "b", "new.txt"), nil, 0644))
+	assert.Equal(t, msg.TYPE_ERROR, config.Remove("-r", "--confirm", s.Token, "a/b").Type)
+	dryRun := new(fs.RemoveSummary)
+	decode(t, config.Remove("-r", "--dry-run", "a/b"), dryRun)
+	s = new(fs.RemoveSummary)
+	decode(t, config.Remove("-r", "--confirm", dryRun.Token, "a/b"), s)
+	assert.Equal(t, []fs.RemoveResult{{Path: "/a/b", Dir: true, Entries: 3, Removed: true}}, s.Results)
+	_, err = os.Stat(filepath.Join(dir, "a", "b"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Invisible files keep their directory
+	s = new(fs.RemoveSummary)
+	decode(t, config.Remove("-r", "--dry-run", "a"), s)
+	assert.Contains(t, s.Results[0].Error, fs.PERM_DENIED)
+}
+
+func TestTrash(t *testing.T) {
+	dir, config := setup(t)
+	defer os.RemoveAll(dir)
+	var items []fs.TrashItem
+	decode(t, config.Trash("ls"), &items)
+	assert.Empty(t, items)
+
+	decode(t, config.Remove("a/one.txt"), new(fs.RemoveSummary))
+	// Overwritten files are kept too
+	decode(t, config.Copy("-f", "a/b/two.txt", "a/b/copy.txt"), new(fs.TransferSummary))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "a", "b", "two.txt"), []byte("2"), 0600))
+	decode(t, config.Copy("-f", "a/b/two.txt", "a/b/copy.txt"), new(fs.TransferSummary))
+
+	decode(t, config.Trash("ls"), &items)
+	if !assert.Len(t, items, 2) {
+		return
+	}
+	assert.Equal(t, "/a/one.txt", items[0].Path)
+	assert.Equal(t, int64(3), items[0].Size)
+	assert.Equal(t, "/a/b/copy.txt", items[1].Path)
+	// The trash itself can't be seen or reached
+	assert.NotContains(t, config.ListFiles().Msg, fs.TRASH_DIR)
+	assert.Equal(t, fs.ERR_NOT_FOUND, config.Copy("/"+fs.TRASH_DIR, "x").Msg)
+
+	// Back where it was
+	var purged []fs.TrashItem
+	decode(t, config.Trash("purge", items[1].ID), &purged)
+	assert.Len(t, purged, 1)
+	res := config.Trash("restore", items[0].ID)
+	assert.Equal(t, msg.TYPE_RESPONSE, res.Type, res.Msg)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "a", "one.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "one", string(data))
+	var left []fs.TrashItem
+	decode(t, config.Trash("ls"), &left)
+	assert.Empty(t, left)
+	assert.Equal(t, msg.TYPE_ERROR, config.Trash("restore", items[0].ID).Type)
+
+	// The policy keeps the trash small
+	config.SetTrashPolicy(fs.TrashPolicy{MaxSize: 3})
+	decode(t, config.Remove("a/one.txt"), new(fs.RemoveSummary))
+	decode(t, config.Remove("a/b/two.txt"), new(fs.RemoveSummary))
+	items = nil
+	decode(t, config.Trash("ls"), &items)
+	if assert.Len(t, items, 1) {
+		assert.Equal(t, "/a/b/two.txt", items[0].Path)
+	}
+	config.SetTrashPolicy(fs.TrashPolicy{MaxAge: time.Nanosecond})
+	items = nil
+	decode(t, config.Trash("ls"), &items)
+	assert.Empty(t, items)
+
+	// Nor does the trash have to be used for items to expire
+	config.SetTrashPolicy(fs.TrashPolicy{MaxAge: 100 * time.Millisecond})
+	defer config.Close()
+	decode(t, config.Remove("a/b/copy.txt"), new(fs.RemoveSummary))
+	trash, err := ioutil.ReadDir(filepath.Join(dir, fs.TRASH_DIR))
+	assert.Nil(t, err)
+	assert.Len(t, trash, 1)
+	time.Sleep(500 * time.Millisecond)
+	trash, err = ioutil.ReadDir(filepath.Join(dir, fs.TRASH_DIR))
+	assert.Nil(t, err)
+	assert.Empty(t, trash)
+}
+
+func TestStat(t *testing.T) {
+	dir, config := setup(t)
+	defer os.RemoveAll(dir)
+	mtime := time.Date(2020, 3, 1, 12, 0, 0, 123456789, time.UTC)
+	assert.Nil(t, os.Chtimes(filepath.Join(dir, "a", "one.txt"), mtime, mtime))
+	assert.Nil(t, os.Symlink("one.txt", filepath.Join(dir, "a", "link")))
+
+	var st fs.FileStat
+	decode(t, config.Stat("a/one.txt"), &st)
+	assert.Equal(t, "/a/one.txt", st.Path)
+	assert.Equal(t, int64(3), st.Size)
+	assert.Equal(t, "-rw-r-----", st.Mode)
+	assert.Equal(t, uint32(0640), st.Perm)
+	assert.True(t, st.ModTime.Equal(mtime), "%s", st.ModTime)
+	assert.Equal(t, "text/plain; charset=utf-8", st.MIME)
+	assert.NotContains(t, config.Stat("a/one.txt").Msg, "Hidden")
+
+	var link fs.FileStat
+	decode(t, config.Stat("a/link"), &link)
+	assert.Equal(t, "one.txt", link.Symlink)
+	assert.Empty(t, link.MIME)
+
+	// Clients can't see invisible files, the host can
+	assert.Equal(t, fs.ERR_NOT_FOUND, config.Stat("a/secret").Msg)
+	hidden, err := config.StatPath("/a/secret")
+	assert.Nil(t, err)
+	assert.True(t, hidden.Hidden)
+	// Not even through a symlink
+	assert.Nil(t, os.Symlink("secret", filepath.Join(dir, "a", "innocent")))
+	assert.Equal(t, fs.ERR_NOT_FOUND, config.Stat("a/innocent").Msg)
+	assert.Equal(t, fs.ERR_NOT_FOUND, config.Read("a/innocent", "0", "100").Msg)
+}
+
+func TestFind(t *testing.T) {
+	dir, config := setup(t)
+	defer os.RemoveAll(dir)
+	old := time.Now().Add(-48 * time.Hour)
+	assert.Nil(t, os.Chtimes(filepath.Join(dir, "a", "one.txt"), old, old))
+
+	find := func(args ...string) ([]string, *msg.Message) {
+		var paths []string
+		res := config.Find(func(m *msg.Message) error {
+			assert.Equal(t, msg.TYPE_STREAM, m.Type)
+			var matches []fs.FindMatch
+			assert.Nil(t, json.Unmarshal([]byte(m.Msg), &matches))
+			for _, match := range matches {
+				paths = append(paths, match.Path)
+			}
+			return nil
+		}, nil, args...)
+		return paths, res
+	}
+
+	paths, res := find("a", "-name", "*.txt")
+	assert.Equal(t, []string{"/a/b/two.txt", "/a/one.txt"}, paths)
+	assert.Equal(t, `{"Matches":2,"Cancelled":false}`, res.Msg)
+	paths, _ = find("-type", "d")
+	assert.Equal(t, []string{"/", "/a", "/a/b"}, paths)
+	paths, _ = find("-type", "f", "-maxdepth", "2")
+	assert.Equal(t, []string{"/a/one.txt"}, paths)
+	paths, _ = find("-type", "f", "-newer", "24h")
+	assert.Equal(t, []string{"/a/b/two.txt"}, paths)
+	paths, _ = find("-size", "+2", "-size", "-4", "-older", "24h")
+	assert.Equal(t, []string{"/a/one.txt"}, paths)
+	// Limits leave out the size given, as find(1) does, which only an exact size takes
+	paths, _ = find("-type", "f", "-size", "+3")
+	assert.Empty(t, paths)
+	paths, _ = find("-type", "f", "-size", "-3")
+	assert.Empty(t, paths)
+	paths, _ = find("-type", "f", "-size", "3")
+	assert.Equal(t, []string{"/a/b/two.txt", "/a/one.txt"}, paths)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "empty"), nil, 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "big"), make([]byte, 5000), 0644))
+	paths, _ = find("-type", "f", "-size", "0")
+	assert.Equal(t, []string{"/empty"}, paths)
+	paths, _ = find("-type", "f", "-size", "+4k")
+	assert.Equal(t, []string{"/big"}, paths)
+	_, res = find("-size", "-0")
+	assert.Equal(t, msg.TYPE_ERROR, res.Type)
+	_, res = find("-size", "lots")
+	assert.Equal(t, msg.TYPE_ERROR, res.Type)
+	_, res = find("../..")
+	assert.Equal(t, fs.PERM_DENIED, res.Msg)
+
+	// Stops part way when cancelled
+	for i := 0; i < 200; i++ {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("f%d", i)), nil, 0644))
+	}
+	cancel := make(chan struct{})
+	parts := 0
+	res = config.Find(func(m *msg.Message) error {
+		parts++
+		close(cancel)
+		return nil
+	}, cancel)
+	assert.Equal(t, 1, parts)
+	var s fs.FindSummary
+	assert.Nil(t, json.Unmarshal([]byte(res.Msg), &s))
+	assert.True(t, s.Cancelled)
+	assert.True(t, s.Matches < 200)
+}
+
+func TestGrep(t *testing.T) {
+	dir, config := setup(t)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "a", "hosts.conf"), []byte("# hosts\nserver db.local\nSERVER web.local\n"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "a", "blob.bin"), []byte("server\x00db.local"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "a", "secret"), []byte("server db.local"), 0644))
+
+	grep := func(args ...string) ([]fs.GrepMatch, *fs.GrepSummary) {
+		var matches []fs.GrepMatch
+		res := config.Grep(func(m *msg.Message) error {
+			var part []fs.GrepMatch
+			assert.Nil(t, json.Unmarshal([]byte(m.Msg), &part))
+			matches = append(matches, part...)
+			return nil
+		}, nil, args...)
+		s := new(fs.GrepSummary)
+		decode(t, res, s)
+		return matches, s
+	}
+
+	matches, s := grep("db\\.local")
+	assert.Equal(t, []fs.GrepMatch{{Path: "/a/hosts.conf", Line: 2, Column: 8, Text: "server db.local"}}, matches)
+	assert.Equal(t, &fs.GrepSummary{Matches: 1, Files: 1, Binary: 1}, s)
+
+	matches, _ = grep("-i", "-F", "server", "a")
+	assert.Len(t, matches, 2)
+	_, s = grep("-i", "-m", "1", "server")
+	assert.Equal(t, 1, s.Matches)
+	assert.True(t, s.Truncated)
+	matches, _ = grep("--include", "*.txt", "o")
+	if assert.Len(t, matches, 2) {
+		assert.Equal(t, "/a/b/two.txt", matches[0].Path)
+	}
+	matches, _ = grep("--exclude", "*.conf", "server")
+	assert.Empty(t, matches)
+
+	assert.Equal(t, msg.TYPE_ERROR, config.Grep(nil, nil, "(").Type)
+
+	// A single big file can be cancelled too
+	big := strings.Repeat("server db.local\n", 100000)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "big.log"), []byte(big), 0644))
+	cancel := make(chan struct{})
+	closed := false
+	res := config.Grep(func(m *msg.Message) error {
+		if !closed {
+			close(cancel)
+			closed = true
+		}
+		return nil
+	}, cancel, "db", "big.log")
+	s = new(fs.GrepSummary)
+	decode(t, res, s)
+	assert.True(t, s.Cancelled)
+	assert.True(t, s.Matches < 100000, "%d", s.Matches)
+
+	// Directories that can't be read are skipped
+	if os.Getuid() == 0 {
+		return
+	}
+	assert.Nil(t, os.Chmod(filepath.Join(dir, "a", "b"), 0))
+	defer os.Chmod(filepath.Join(dir, "a", "b"), 0755)
+	matches, s = grep("server", "a")
+	assert.Equal(t, 1, s.Matches)
+	assert.Len(t, matches, 1)
+}
+
+func TestUsage(t *testing.T) {
+	dir, config := setup(t)
+	defer os.RemoveAll(dir)
+
+	var tree fs.DirUsage
+	decode(t, config.Tree(), &tree)
+	// Invisible files don't count
+	assert.Equal(t, fs.DirUsage{Path: "/", Size: 6, Files: 2, Dirs: 2, Children: []*fs.DirUsage{
+		{Path: "/a", Size: 6, Files: 2, Dirs: 1, Children: []*fs.DirUsage{
+			{Path: "/a/b", Size: 3, Files: 1},
+		}},
+	}}, tree)
+
+	du := func(args ...string) []fs.DirUsage {
+		var list []fs.DirUsage
+		decode(t, config.DiskUsage(args...), &list)
+		return list
+	}
+	assert.Equal(t, []fs.DirUsage{{Path: "/a", Size: 6, Files: 2, Dirs: 1}, {Path: "/", Size: 6, Files: 2, Dirs: 2}}, du())
+	assert.Equal(t, []fs.DirUsage{{Path: "/a", Size: 6, Files: 2, Dirs: 1}}, du("a", "-d", "0"))
+
+	// Files growing in place count as they are now, though their directory doesn't change
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "a", "b", "two.txt"), []byte("two two"), 0600))
+	assert.Equal(t, int64(7), du("a/b")[0].Size)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "a", "b", "three.txt"), []byte("3"), 0600))
+	assert.Equal(t, fs.DirUsage{Path: "/a/b", Size: 8, Files: 2}, du("a/b")[0])
+
+	// Directories whose mtime holds aren't read again, a name slipped in behind its back goes unseen
+	b := filepath.Join(dir, "a", "b")
+	info, err := os.Stat(b)
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(b, "four.txt"), []byte("4"), 0600))
+	assert.Nil(t, os.Chtimes(b, info.ModTime(), info.ModTime()))
+	assert.Equal(t, fs.DirUsage{Path: "/a/b", Size: 8, Files: 2}, du("a/b")[0])
+	now := time.Now()
+	assert.Nil(t, os.Chtimes(b, now, now))
+	assert.Equal(t, fs.DirUsage{Path: "/a/b", Size: 9, Files: 3}, du("a/b")[0])
+}
+
+// benchmarkUsage runs du on a tree of 100 directories of 100 files, from a fresh cache each time unless cached
+func benchmarkUsage(b *testing.B, cached bool) {
+	dir, err := ioutil.TempDir("", "fs")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for i := 0; i < 100; i++ {
+		sub := filepath.Join(dir, fmt.Sprintf("d%d", i))
+		if err := os.Mkdir(sub, 0755); err != nil {
+			b.Fatal(err)
+		}
+		for j := 0; j < 100; j++ {
+			if err := ioutil.WriteFile(filepath.Join(sub, fmt.Sprintf("f%d", j)), []byte("x"), 0644); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	config, err := fs.Init(dir, []string{"*.pem", "/secrets/", "**/cache/**"}, false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	config.DiskUsage()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !cached {
+			b.StopTimer()
+			config, _ = fs.Init(dir, []string{"*.pem", "/secrets/", "**/cache/**"}, false)
+			b.StartTimer()
+		}
+		if res := config.DiskUsage(); res.Type != msg.TYPE_RESPONSE {
+			b.Fatal(res.Msg)
+		}
+	}
+}
+
+func BenchmarkUsageCold(b *testing.B) {
+	benchmarkUsage(b, false)
+}
+
+func BenchmarkUsageCached(b *testing.B) {
+	benchmarkUsage(b, true)
+}
+
+func TestHeadTailRead(t *testing.T) {
+	dir, config := setup(t)
+	defer os.RemoveAll(dir)
+	log := filepath.Join(dir, "a", "app.log")
+	assert.Nil(t, ioutil.WriteFile(log, []byte("1\n2\n3\n4\n"), 0644))
+
+	data := func(res *msg.Message) string {
+		var c fs.FileChunk
+		decode(t, res, &c)
+		return string(c.Data)
+	}
+	assert.Equal(t, "1\n2\n", data(config.Head("-n", "2", "a/app.log")))
+	assert.Equal(t, "1\n2", data(config.Head("-c", "3", "a/app.log")))
+	c := new(fs.FileChunk)
+	decode(t, config.Tail(nil, nil, "-n", "2", "a/app.log"), c)
+	assert.Equal(t, &fs.FileChunk{Path: "/a/app.log", Offset: 4, Data: []byte("3\n4\n"), Size: 8, EOF: true}, c)
+	assert.Equal(t, "4\n", data(config.Tail(nil, nil, "-c", "2", "a/app.log")))
+	assert.Equal(t, "1\n2\n3\n4\n", data(config.Tail(nil, nil, "a/app.log")))
+	c = new(fs.FileChunk)
+	decode(t, config.Read("a/app.log", "2", "3"), c)
+	assert.Equal(t, "2\n3", string(c.Data))
+	assert.False(t, c.EOF)
+	assert.Empty(t, data(config.Read("a/app.log", "100", "3")))
+	assert.Equal(t, msg.TYPE_ERROR, config.Read("a/secret", "0", "1").Type)
+	assert.Equal(t, msg.TYPE_ERROR, config.Head("a").Type)
+
+	// Follow the log as it grows until cancelled
+	parts := make(chan string, 10)
+	cancel := make(chan struct{})
+	done := make(chan *msg.Message)
+	go func() {
+		done <- config.Tail(func(m *msg.Message) error {
+			var part fs.FileChunk
+			assert.Equal(t, msg.TYPE_STREAM, m.Type)
+			assert.Nil(t, json.Unmarshal([]byte(m.Msg), &part))
+			parts <- string(part.Data)
+			return nil
+		}, cancel, "-f", "-n", "1", "a/app.log")
+	}()
+	assert.Equal(t, "4\n", <-parts)
+	f, err := os.OpenFile(log, os.O_APPEND|os.O_WRONLY, 0)
+	assert.Nil(t, err)
+	f.WriteString("5\n")
+	f.Close()
+	assert.Equal(t, "5\n", <-parts)
+	close(cancel)
+	c = new(fs.FileChunk)
+	decode(t, <-done, c)
+	assert.Equal(t, int64(10), c.Offset)
+}
+
+func TestTailFollow(t *testing.T) {
+	dir, config := setup(t)
+	defer os.RemoveAll(dir)
+	log := filepath.Join(dir, "a", "app.log")
+	assert.Nil(t, ioutil.WriteFile(log, []byte("1\n"), 0644))
+	appendTo := func(p, s string) {
+		f, err := os.OpenFile(p, os.O_APPEND|os.O_WRONLY, 0)
+		assert.Nil(t, err)
+		f.WriteString(s)
+		f.Close()
+	}
+
+	parts := make(chan string, 10)
+	cancel := make(chan struct{})
+	done := make(chan *msg.Message)
+	go func() {
+		done <- config.Tail(func(m *msg.Message) error {
+			var part fs.FileChunk
+			assert.Nil(t, json.Unmarshal([]byte(m.Msg), &part))
+			parts <- string(part.Data)
+			return nil
+		}, cancel, "-f", "a/app.log")
+	}()
+	// read waits for parts until they add up to want
+	read := func(want string) {
+		got := ""
+		for len(got) < len(want) {
+			select {
+			case part := <-parts:
+				got += part
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Only got %q", got)
+			}
+		}
+		assert.Equal(t, want, got)
+	}
+	read("1\n")
+
+	// Rotated, what was still written to the old file comes before the new one
+	appendTo(log, "2\n")
+	assert.Nil(t, os.Rename(log, log+".1"))
+	appendTo(log+".1", "3\n")
+	assert.Nil(t, ioutil.WriteFile(log, []byte("new\n"), 0644))
+	read("2\n3\nnew\n")
+
+	// Truncated, it starts over
+	assert.Nil(t, ioutil.WriteFile(log, []byte("x\n"), 0644))
+	read("x\n")
+
+	close(cancel)
+	res := <-done
+	assert.Equal(t, msg.TYPE_RESPONSE, res.Type, res.Msg)
+}
+
+func TestWatch(t *testing.T) {
+	dir, config := setup(t)
+	defer os.RemoveAll(dir)
+
+	events := make(chan fs.WatchEvent, 100)
+	cancel := make(chan struct{})
+	done := make(chan *msg.Message)
+	go func() {
+		done <- config.Watch(func(m *msg.Message) error {
+			var part []fs.WatchEvent
+			assert.Nil(t, json.Unmarshal([]byte(m.Msg), &part))
+			for _, e := range part {
+				events <- e
+			}
+			return nil
+		}, cancel, "a")
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	a := filepath.Join(dir, "a")
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(a, "new.txt"), []byte("new"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(a, "secret"), []byte("changed"), 0644))
+	assert.Nil(t, os.Mkdir(filepath.Join(a, "c"), 0755))
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(a, "c", "three.txt"), []byte("3"), 0644))
+	assert.Nil(t, os.Rename(filepath.Join(a, "new.txt"), filepath.Join(a, "renamed.txt")))
+	assert.Nil(t, os.Remove(filepath.Join(a, "renamed.txt")))
+
+	seen := make(map[fs.WatchEvent]bool)
+	timeout := time.After(5 * time.Second)
+	for !seen[fs.WatchEvent{Path: "/a/renamed.txt", Op: fs.WATCH_REMOVE}] {
+		select {
+		case e := <-events:
+			seen[e] = true
+		case <-timeout:
+			t.Fatalf("Only saw %v", seen)
+		}
+	}
+	close(cancel)
+	res := <-done
+	assert.Equal(t, msg.TYPE_RESPONSE, res.Type, res.Msg)
+
+	assert.True(t, seen[fs.WatchEvent{Path: "/a/new.txt", Op: fs.WATCH_CREATE}])
+	assert.True(t, seen[fs.WatchEvent{Path: "/a/c", Op: fs.WATCH_CREATE, Dir: true}])
+	assert.True(t, seen[fs.WatchEvent{Path: "/a/c/three.txt", Op: fs.WATCH_CREATE}])
+	assert.True(t, seen[fs.WatchEvent{Path: "/a/renamed.txt", Op: fs.WATCH_RENAME, From: "/a/new.txt"}])
+	for e := range seen {
+		assert.NotEqual(t, "/a/secret", e.Path)
+	}
+	assert.Equal(t, msg.TYPE_ERROR, config.Watch(nil, nil, "a/secret").Type)
+}
+
+func TestWatchThroughSymlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fs")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "a", "b"), 0755))
+	assert.Nil(t, os.Symlink(filepath.Join("a", "b"), filepath.Join(dir, "link")))
+	assert.Nil(t, os.Symlink("a", filepath.Join(dir, "up")))
+	config, err := fs.Init(dir, []string{"/a/b/secret.pem"}, false)
+	assert.Nil(t, err)
+
+	// A symlink would have where it leads watched under its own name, out of reach of anchored rules
+	assert.Equal(t, msg.TYPE_ERROR, config.Watch(nil, nil, "link").Type)
+
+	// Through a symlinked directory, changes show where they really are
+	events := make(chan fs.WatchEvent, 100)
+	cancel := make(chan struct{})
+	done := make(chan *msg.Message)
+	go func() {
+		done <- config.Watch(func(m *msg.Message) error {
+			var part []fs.WatchEvent
+			assert.Nil(t, json.Unmarshal([]byte(m.Msg), &part))
+			for _, e := range part {
+				events <- e
+			}
+			return nil
+		}, cancel, "up/b")
+	}()
+	time.Sleep(100 * time.Millisecond)
+	b := filepath.Join(dir, "a", "b")
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(b, "secret.pem"), []byte("key"), 0600))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(b, "public.pem"), []byte("key"), 0644))
+
+	seen := make(map[fs.WatchEvent]bool)
+	timeout := time.After(5 * time.Second)
+	for !seen[fs.WatchEvent{Path: "/a/b/public.pem", Op: fs.WATCH_CREATE}] {
+		select {
+		case e := <-events:
+			seen[e] = true
+		case <-timeout:
+			t.Fatalf("Only saw %v", seen)
+		}
+	}
+	close(cancel)
+	res := <-done
+	assert.Equal(t, msg.TYPE_RESPONSE, res.Type, res.Msg)
+	for e := range seen {
+		assert.NotContains(t, e.Path, "secret")
+	}
+}
+
+func TestInvisibleRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fs")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	for _, p := range []string{"keys/private.pem", "keys/public.pem", "keys/readme", "tcp2/relay", "a/tcp2/relay", "a/cache/tmp"} {
+		assert.Nil(t, os.MkdirAll(filepath.Join(dir, filepath.Dir(p)), 0755))
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, p), []byte(p), 0644))
+	}
+	_, err = fs.Init(dir, []string{"["}, false)
+	assert.NotNil(t, err)
+	config, err := fs.Init(dir, []string{"# keys", "keys/*.pem", "!keys/public.pem", "/tcp2/", "**/cache/**"}, false)
+	assert.Nil(t, err)
+
+	assert.Equal(t, msg.TYPE_ERROR, config.Stat("keys/private.pem").Type)
+	assert.Equal(t, msg.TYPE_RESPONSE, config.Stat("keys/public.pem").Type)
+	assert.Equal(t, msg.TYPE_ERROR, config.Stat("/tcp2/relay").Type)
+	assert.Equal(t, msg.TYPE_ERROR, config.Stat("a/cache/tmp").Type)
+	assert.Equal(t, msg.TYPE_RESPONSE, config.Stat("a/cache").Type)
+	hidden, err := config.StatPath("keys/private.pem")
+	assert.Nil(t, err)
+	assert.True(t, hidden.Hidden)
+
+	ls := config.ListFiles().Msg
+	assert.Contains(t, ls, ".keys")
+	assert.NotContains(t, ls, ".tcp2")
+
+	assert.Equal(t, msg.TYPE_ERROR, config.CD("tcp2").Type)
+	assert.Equal(t, msg.TYPE_ERROR, config.CD("keys/readme").Type)
+	assert.Equal(t, msg.TYPE_ERROR, config.CD("../..").Type)
+	assert.Equal(t, msg.TYPE_RESPONSE, config.CD("a/tcp2").Type)
+	assert.Contains(t, config.ListFiles().Msg, "relay")
+	assert.Equal(t, msg.TYPE_RESPONSE, config.CD("/").Type)
+
+	var found []string
+	res := config.Find(func(m *msg.Message) error {
+		var part []fs.FindMatch
+		assert.Nil(t, json.Unmarshal([]byte(m.Msg), &part))
+		for _, match := range part {
+			found = append(found, match.Path)
+		}
+		return nil
+	}, nil, "-type", "f")
+	assert.Equal(t, msg.TYPE_RESPONSE, res.Type, res.Msg)
+	assert.ElementsMatch(t, []string{"/keys/public.pem", "/keys/readme", "/a/tcp2/relay"}, found)
+
+	// Nothing can be written where it would be invisible
+	assert.Equal(t, msg.TYPE_ERROR, config.Copy("keys/readme", "keys/copy.pem").Type)
+	assert.Equal(t, msg.TYPE_ERROR, config.Move("a", "tcp2").Type)
+	assert.Equal(t, msg.TYPE_ERROR, config.Mkdir("tcp2").Type)
+
+	// Nor can anything invisible be reached through a symlink, to it or to a directory holding it
+	assert.Nil(t, os.Symlink("private.pem", filepath.Join(dir, "keys", "innocent")))
+	assert.Nil(t, os.Symlink("../tcp2", filepath.Join(dir, "a", "tools")))
+	assert.Equal(t, fs.ERR_NOT_FOUND, config.Read("keys/innocent", "0", "100").Msg)
+	assert.Equal(t, fs.ERR_NOT_FOUND, config.Read("a/tools/relay", "0", "100").Msg)
+	assert.Equal(t, msg.TYPE_ERROR, config.CD("a/tools").Type)
+	assert.Equal(t, msg.TYPE_ERROR, config.Copy("keys/readme", "a/tools/copy").Type)
+}
+
+func TestSessions(t *testing.T) {
+	dir, config := setup(t)
+	defer os.RemoveAll(dir)
+
+	// Each session moves around on its own
+	first, second := config.Session(), config.Session()
+	assert.Equal(t, msg.New(msg.TYPE_RESPONSE, "/a"), first.CD("a"))
+	assert.Equal(t, msg.TYPE_RESPONSE, first.Stat("one.txt").Type)
+	assert.Equal(t, fs.ERR_NOT_FOUND, second.Stat("one.txt").Msg)
+	assert.Equal(t, msg.TYPE_RESPONSE, second.CD("a/b").Type)
+	assert.Equal(t, msg.TYPE_RESPONSE, second.Stat("two.txt").Type)
+	assert.Equal(t, msg.TYPE_RESPONSE, first.Stat("one.txt").Type)
+	assert.Equal(t, fs.ERR_NOT_FOUND, config.Stat("one.txt").Msg)
+	// Only where they are in baseDir is shown, not where that is on the host
+	assert.Equal(t, msg.New(msg.TYPE_RESPONSE, "/a/b"), second.CD())
+	assert.Equal(t, msg.New(msg.TYPE_RESPONSE, "/"), config.CD())
+	assert.Contains(t, second.ListFiles().Msg, "Directory: /a/b\n")
+	assert.NotContains(t, second.ListFiles().Msg, dir)
+
+	// Changing directory while others use theirs
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			first.CD("/a/b")
+			first.CD("/a")
+		}
+		close(done)
+	}()
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, msg.TYPE_RESPONSE, second.Stat("two.txt").Type)
+	}
+	<-done
+}
@@ -0,0 +1,231 @@
+package fs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	msg "github.com/miska12345/MiskaRFS/src/message"
+)
+
+// GrepMatch is a line grep found the pattern on
+type GrepMatch struct {
+	Path string
+	// Line and Column count from 1, Column in bytes
+	Line   int
+	Column int
+	Text   string
+}
+
+// GrepSummary is the last part of a grep
+type GrepSummary struct {
+	Matches int
+	Files   int
+	// Binary files are skipped
+	Binary int
+	// Truncated is set when the maximum number of matches was reached
+	Truncated bool
+	Cancelled bool
+}
+
+const (
+	// Files with a NUL byte this far in are binary
+	binarySniff = 8000
+	// Longer lines are cut short in matches, and lines past maxLine end the search of their file
+	maxMatchText = 512
+	maxLine      = 1 << 20
+)
+
+type grepQuery struct {
+	pattern    *regexp.Regexp
+	root       string
+	include    []string
+	exclude    []string
+	maxMatches int
+}
+
+// parseGrep reads: [-F] [-i] [-m N] [--include glob]... [--exclude glob]... <pattern> [path]
+func parseGrep(args []string) (q grepQuery, err error) {
+	q.root = "."
+	literal, ignoreCase := false, false
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch arg {
+		case "":
+			continue
+		case "-F":
+			literal = true
+			continue
+		case "-i":
+			ignoreCase = true
+			continue
+		case "-m", "--include", "--exclude":
+			if i+1 == len(args) {
+				return q, fmt.Errorf("%s needs a value", arg)
+			}
+			i++
+			value := args[i]
+			switch arg {
+			case "-m":
+				if q.maxMatches, err = strconv.Atoi(value); err != nil || q.maxMatches < 1 {
+					return q, fmt.Errorf("-m is a number of matches")
+				}
+			case "--include":
+				q.include = append(q.include, value)
+			case "--exclude":
+				q.exclude = append(q.exclude, value)
+			}
+			if _, err = filepath.Match(value, ""); err != nil {
+				return
+			}
+			continue
+		}
+		if strings.HasPrefix(arg, "-") && len(rest) == 0 {
+			return q, fmt.Errorf("Unknown option %s", arg)
+		}
+		rest = append(rest, arg)
+	}
+	if len(rest) == 0 || len(rest) > 2 {
+		return q, fmt.Errorf("grep [-F] [-i] [-m N] [--include glob] [--exclude glob] <pattern> [path]")
+	}
+	pattern := rest[0]
+	if literal {
+		pattern = regexp.QuoteMeta(pattern)
+	}
+	if ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+	if q.pattern, err = regexp.Compile(pattern); err != nil {
+		return
+	}
+	if len(rest) == 2 {
+		q.root = rest[1]
+	}
+	return q, nil
+}
+
+// wanted tells whether a file called name is searched
+func (q *grepQuery) wanted(name string) bool {
+	for _, glob := range q.exclude {
+		if ok, _ := filepath.Match(glob, name); ok {
+			return false
+		}
+	}
+	if len(q.include) == 0 {
+		return true
+	}
+	for _, glob := range q.include {
+		if ok, _ := filepath.Match(glob, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Grep searches the contents of files under the current directory, or the path given, sending matching
+// lines in batches as it goes until it is done, reaches the maximum number of matches or cancel is closed.
+// See parseGrep for the options. Invisible and binary files are left out.
+func (fs *FSConfig) Grep(send func(*msg.Message) error, cancel <-chan struct{}, args ...string) *msg.Message {
+	q, err := parseGrep(args)
+	if err != nil {
+		return msg.New(msg.TYPE_ERROR, err.Error())
+	}
+	root, err := fs.resolve(q.root)
+	if err != nil {
+		return msg.New(msg.TYPE_ERROR, err.Error())
+	}
+	if _, err = os.Lstat(root); err != nil {
+		return msg.New(msg.TYPE_ERROR, ERR_NOT_FOUND)
+	}
+
+	results := newBatcher(send)
+	summary := &GrepSummary{}
+	err = fs.walkReadable(root, func(p string, info os.FileInfo) error {
+		if cancelled(cancel) {
+			return errCancelled
+		}
+		if !info.Mode().IsRegular() || !q.wanted(info.Name()) {
+			return nil
+		}
+		return fs.grepFile(p, &q, results, summary, cancel)
+	})
+	if err == nil || err == errTruncated {
+		err = results.flush()
+	}
+	switch err {
+	case nil:
+	case errCancelled:
+		summary.Cancelled = true
+	default:
+		return msg.New(msg.TYPE_ERROR, err.Error())
+	}
+	bys, err := json.Marshal(summary)
+	if err != nil {
+		return msg.New(msg.TYPE_ERROR, err.Error())
+	}
+	return msg.New(msg.TYPE_RESPONSE, string(bys))
+}
+
+// errTruncated stops a grep that has found enough
+var errTruncated = fmt.Errorf("truncated")
+
+// grepCheck is how many lines grepFile reads between looking at cancel
+const grepCheck = 1024
+
+func (fs *FSConfig) grepFile(p string, q *grepQuery, results *batcher, summary *GrepSummary, cancel <-chan struct{}) error {
+	f, err := os.Open(p)
+	if err != nil {
+		// Unreadable files are skipped
+		return nil
+	}
+	defer f.Close()
+	r := bufio.NewReaderSize(f, binarySniff)
+	head, _ := r.Peek(binarySniff)
+	if bytes.IndexByte(head, 0) >= 0 {
+		summary.Binary++
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLine)
+	found := false
+	for line := 1; scanner.Scan(); line++ {
+		if line%grepCheck == 0 && cancelled(cancel) {
+			return errCancelled
+		}
+		text := scanner.Bytes()
+		loc := q.pattern.FindIndex(text)
+		if loc == nil {
+			continue
+		}
+		if !found {
+			found = true
+			summary.Files++
+		}
+		if len(text) > maxMatchText {
+			text = text[:maxMatchText]
+		}
+		summary.Matches++
+		err := results.add(GrepMatch{
+			Path:   fs.display(p),
+			Line:   line,
+			Column: loc[0] + 1,
+			Text:   string(text),
+		})
+		if err != nil {
+			return err
+		}
+		if q.maxMatches > 0 && summary.Matches >= q.maxMatches {
+			summary.Truncated = true
+			return errTruncated
+		}
+	}
+	return nil
+}
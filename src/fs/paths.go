@@ -0,0 +1,103 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ERR_NOT_FOUND is what clients are told about missing and invisible paths alike
+const ERR_NOT_FOUND = "NO SUCH FILE OR DIRECTORY"
+
+// root is baseDir as an absolute path with symlinks resolved
+func (fs *FSConfig) root() (string, error) {
+	base, err := filepath.Abs(fs.baseDir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(base)
+}
+
+// resolve turns a path from a client into one on disk. Relative paths start at the current
+// directory and absolute ones at baseDir. Anything outside baseDir, directly or through
+// a symlink, is refused, as is anything invisible, whether as given or where symlinks lead.
+func (fs *FSConfig) resolve(p string) (string, error) {
+	root, err := fs.root()
+	if err != nil {
+		return "", err
+	}
+	var full string
+	if strings.HasPrefix(p, "/") {
+		full = filepath.Join(root, filepath.FromSlash(p))
+	} else {
+		cur, err := filepath.Abs(fs.currentDir())
+		if err != nil {
+			return "", err
+		}
+		if real, err := filepath.EvalSymlinks(cur); err == nil {
+			cur = real
+		}
+		full = filepath.Join(cur, filepath.FromSlash(p))
+	}
+	if !within(root, full) {
+		return "", fmt.Errorf(PERM_DENIED)
+	}
+	// Whatever part of it exists must not lead out through a symlink
+	existing := full
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		existing = filepath.Dir(existing)
+	}
+	real, err := filepath.EvalSymlinks(existing)
+	if err != nil || !within(root, real) {
+		return "", fmt.Errorf(PERM_DENIED)
+	}
+	rest, err := filepath.Rel(existing, full)
+	if err != nil {
+		return "", err
+	}
+	if fs.hidden(root, full) || fs.hidden(root, filepath.Join(real, rest)) {
+		return "", fmt.Errorf(ERR_NOT_FOUND)
+	}
+	return full, nil
+}
+
+// within tells whether p is root or inside it
+func within(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// hidden tells whether p below root is invisible, itself or by being in an invisible directory
+func (fs *FSConfig) hidden(root, p string) bool {
+	info, err := os.Lstat(p)
+	return fs.invisible(root, p, err == nil && info.IsDir())
+}
+
+// invisible is hidden for callers that know whether p is a directory
+func (fs *FSConfig) invisible(root, p string, dir bool) bool {
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return true
+	}
+	return fs.invisibleFiles.match(filepath.ToSlash(rel), dir)
+}
+
+// display is how p is shown to clients, relative to baseDir
+func (fs *FSConfig) display(p string) string {
+	root, err := fs.root()
+	if err != nil {
+		return filepath.Base(p)
+	}
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return filepath.Base(p)
+	}
+	if rel == "." {
+		return "/"
+	}
+	return "/" + filepath.ToSlash(rel)
+}
@@ -0,0 +1,308 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	msg "github.com/miska12345/MiskaRFS/src/message"
+)
+
+// FileChunk is part of a file, Data is base64 in JSON
+type FileChunk struct {
+	Path   string
+	Offset int64
+	Data   []byte
+	// Size is how big the file was when it was read
+	Size int64
+	// EOF is set when Data runs to the end of the file
+	EOF bool
+}
+
+const (
+	// maxRead bounds how much a single read, head or tail returns
+	maxRead = 4 << 20
+	// defaultLines is what head and tail show without -n or -c
+	defaultLines = 10
+	// tailBlock is how much tail reads at a time going backwards for lines
+	tailBlock = 32 << 10
+)
+
+// followInterval is how often tail -f checks for more
+var followInterval = 250 * time.Millisecond
+
+// openRegular opens a regular file in the sandbox for reading
+func (fs *FSConfig) openRegular(p string) (*os.File, os.FileInfo, string, error) {
+	full, err := fs.resolve(p)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	f, err := os.Open(full)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf(ERR_NOT_FOUND)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, "", err
+	}
+	if !info.Mode().IsRegular() {
+		f.Close()
+		return nil, nil, "", fmt.Errorf("%s is not a regular file", p)
+	}
+	return f, info, full, nil
+}
+
+// readAt reads up to length bytes at offset
+func (fs *FSConfig) readAt(f *os.File, full string, offset, length, size int64) (*FileChunk, error) {
+	if offset > size {
+		offset = size
+	}
+	if length > size-offset {
+		length = size - offset
+	}
+	data := make([]byte, length)
+	n, err := f.ReadAt(data, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return &FileChunk{
+		Path:   fs.display(full),
+		Offset: offset,
+		Data:   data[:n],
+		Size:   size,
+		EOF:    offset+int64(n) >= size,
+	}, nil
+}
+
+// parseCount reads: [-n lines | -c bytes] <path>, with the rest of the flags left to the caller
+func parseCount(args []string, flags map[string]*bool) (p string, lines, count int64, err error) {
+	lines = defaultLines
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if flag, ok := flags[arg]; ok {
+			*flag = true
+			continue
+		}
+		switch arg {
+		case "":
+		case "-n", "-c":
+			if i+1 == len(args) {
+				return "", 0, 0, fmt.Errorf("%s needs a number", arg)
+			}
+			i++
+			n, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil || n < 0 {
+				return "", 0, 0, fmt.Errorf("%s needs a number", arg)
+			}
+			if arg == "-n" {
+				lines, count = n, 0
+			} else {
+				lines, count = 0, n
+			}
+		default:
+			if p != "" {
+				return "", 0, 0, fmt.Errorf("Unexpected %s", arg)
+			}
+			p = arg
+		}
+	}
+	if p == "" {
+		return "", 0, 0, fmt.Errorf("Which file?")
+	}
+	if count > maxRead {
+		count = maxRead
+	}
+	return
+}
+
+// Read returns length bytes of a file from offset: read <path> <offset> <length>
+func (fs *FSConfig) Read(args ...string) *msg.Message {
+	if len(args) != 3 {
+		return msg.New(msg.TYPE_ERROR, "read <path> <offset> <length>")
+	}
+	offset, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || offset < 0 {
+		return msg.New(msg.TYPE_ERROR, "Bad offset "+args[1])
+	}
+	length, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || length < 0 {
+		return msg.New(msg.TYPE_ERROR, "Bad length "+args[2])
+	}
+	if length > maxRead {
+		length = maxRead
+	}
+	f, info, full, err := fs.openRegular(args[0])
+	if err != nil {
+		return msg.New(msg.TYPE_ERROR, err.Error())
+	}
+	defer f.Close()
+	chunk, err := fs.readAt(f, full, offset, length, info.Size())
+	if err != nil {
+		return msg.New(msg.TYPE_ERROR, err.Error())
+	}
+	return jsonResponse(chunk)
+}
+
+// Head returns the first lines or bytes of a file: head [-n lines | -c bytes] <path>
+func (fs *FSConfig) Head(args ...string) *msg.Message {
+	p, lines, count, err := parseCount(args, nil)
+	if err != nil {
+		return msg.New(msg.TYPE_ERROR, err.Error())
+	}
+	f, info, full, err := fs.openRegular(p)
+	if err != nil {
+		return msg.New(msg.TYPE_ERROR, err.Error())
+	}
+	defer f.Close()
+	if lines == 0 {
+		chunk, err := fs.readAt(f, full, 0, count, info.Size())
+		if err != nil {
+			return msg.New(msg.TYPE_ERROR, err.Error())
+		}
+		return jsonResponse(chunk)
+	}
+	chunk, err := fs.readAt(f, full, 0, maxRead, info.Size())
+	if err != nil {
+		return msg.New(msg.TYPE_ERROR, err.Error())
+	}
+	end := 0
+	for i := int64(0); i < lines; i++ {
+		next := bytes.IndexByte(chunk.Data[end:], '\n')
+		if next < 0 {
+			end = len(chunk.Data)
+			break
+		}
+		end += next + 1
+	}
+	chunk.Data = chunk.Data[:end]
+	chunk.EOF = int64(end) >= chunk.Size
+	return jsonResponse(chunk)
+}
+
+// Tail returns the last lines or bytes of a file: tail [-n lines | -c bytes] [-f] <path>.
+// With -f it goes on sending what is appended to the file as it grows until cancel is closed.
+// It starts over if the file is truncated, and if the file is rotated it goes on with the one
+// taking its place once what is left of the old one has been sent.
+func (fs *FSConfig) Tail(send func(*msg.Message) error, cancel <-chan struct{}, args ...string) *msg.Message {
+	follow := false
+	p, lines, count, err := parseCount(args, map[string]*bool{"-f": &follow})
+	if err != nil {
+		return msg.New(msg.TYPE_ERROR, err.Error())
+	}
+	f, info, full, err := fs.openRegular(p)
+	if err != nil {
+		return msg.New(msg.TYPE_ERROR, err.Error())
+	}
+	// f is reopened when the file is replaced
+	defer func() {
+		f.Close()
+	}()
+
+	start := info.Size() - count
+	if lines > 0 {
+		start, err = lastLines(f, info.Size(), lines)
+		if err != nil {
+			return msg.New(msg.TYPE_ERROR, err.Error())
+		}
+	}
+	if start < 0 {
+		start = 0
+	}
+	chunk, err := fs.readAt(f, full, start, info.Size()-start, info.Size())
+	if err != nil {
+		return msg.New(msg.TYPE_ERROR, err.Error())
+	}
+	if !follow {
+		return jsonResponse(chunk)
+	}
+
+	ticker := time.NewTicker(followInterval)
+	defer ticker.Stop()
+	for {
+		if len(chunk.Data) > 0 {
+			bys, err := json.Marshal(chunk)
+			if err == nil {
+				err = send(msg.New(msg.TYPE_STREAM, string(bys)))
+			}
+			if err != nil {
+				return msg.New(msg.TYPE_ERROR, err.Error())
+			}
+		}
+		offset := chunk.Offset + int64(len(chunk.Data))
+		select {
+		case <-cancel:
+			return jsonResponse(&FileChunk{Path: chunk.Path, Offset: offset, Size: chunk.Size, EOF: true})
+		case <-ticker.C:
+		}
+
+		if info, err = f.Stat(); err != nil {
+			return msg.New(msg.TYPE_ERROR, err.Error())
+		}
+		if info.Size() < offset {
+			// Truncated, start again from the top
+			offset = 0
+		}
+		if chunk, err = fs.readAt(f, full, offset, maxRead, info.Size()); err != nil {
+			return msg.New(msg.TYPE_ERROR, err.Error())
+		}
+		if len(chunk.Data) > 0 {
+			continue
+		}
+		// Nothing more in this file, if another has taken its place that is the one to follow now
+		if now, err := os.Stat(full); err != nil || os.SameFile(info, now) {
+			continue
+		}
+		next, nextInfo, nextFull, err := fs.openRegular(chunk.Path)
+		if err != nil {
+			// Not there for clients to see yet, or at all
+			continue
+		}
+		f.Close()
+		f, info, full = next, nextInfo, nextFull
+		if chunk, err = fs.readAt(f, full, 0, maxRead, info.Size()); err != nil {
+			return msg.New(msg.TYPE_ERROR, err.Error())
+		}
+	}
+}
+
+// lastLines finds where the last n lines of a file of size bytes start, no more than maxRead from its end
+func lastLines(f *os.File, size, n int64) (int64, error) {
+	pos := size
+	found := int64(0)
+	buf := make([]byte, tailBlock)
+	// A newline ending the file doesn't start another line
+	skip := true
+	for pos > 0 && size-pos < maxRead {
+		block := int64(len(buf))
+		if block > pos {
+			block = pos
+		}
+		pos -= block
+		if _, err := f.ReadAt(buf[:block], pos); err != nil && err != io.EOF {
+			return 0, err
+		}
+		for i := block - 1; i >= 0; i-- {
+			if buf[i] != '\n' {
+				skip = false
+				continue
+			}
+			if skip {
+				skip = false
+				continue
+			}
+			found++
+			if found == n {
+				return pos + i + 1, nil
+			}
+		}
+	}
+	if size-pos >= maxRead {
+		return size - maxRead, nil
+	}
+	return 0, nil
+}
@@ -0,0 +1,224 @@
+package fs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	msg "github.com/miska12345/MiskaRFS/src/message"
+)
+
+// RemoveResult is what happened to one path
+type RemoveResult struct {
+	Path string
+	Dir  bool
+	// Entries is how many files and directories went with it, itself included
+	Entries int
+	Removed bool
+	Error   string `json:",omitempty"`
+}
+
+// RemoveSummary is what Remove sends back, as JSON
+type RemoveSummary struct {
+	DryRun bool
+	// Token confirms a recursive remove of exactly what the dry run listed
+	Token   string `json:",omitempty"`
+	Results []RemoveResult
+}
+
+// removeOptions come from the flags before the paths
+type removeOptions struct {
+	recursive bool
+	dryRun    bool
+	token     string
+}
+
+func parseRemoveArgs(args []string) (opts removeOptions, paths []string, err error) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "":
+		case arg == "--dry-run":
+			opts.dryRun = true
+		case arg == "--confirm":
+			if i+1 == len(args) {
+				return opts, nil, fmt.Errorf("--confirm needs the token from a dry run")
+			}
+			i++
+			opts.token = args[i]
+		case arg == "-r" || arg == "-R":
+			opts.recursive = true
+		case strings.HasPrefix(arg, "-") && arg != "-":
+			return opts, nil, fmt.Errorf("Unknown option %s", arg)
+		default:
+			paths = append(paths, arg)
+		}
+	}
+	if len(paths) == 0 {
+		return opts, nil, fmt.Errorf("Nothing to remove")
+	}
+	return
+}
+
+// Remove moves files and empty directories to the trash: rm [-r] [--dry-run] [--confirm <token>] <path>...
+// Removing directories with everything in them takes -r and the token from a dry run of the same command,
+// which stops working as soon as anything it listed changes.
+// baseDir itself and directories holding invisible files are never removed.
+func (fs *FSConfig) Remove(args ...string) *msg.Message {
+	if fs.readOnly {
+		return msg.New(msg.TYPE_ERROR, PERM_DENIED)
+	}
+	opts, paths, err := parseRemoveArgs(args)
+	if err != nil {
+		return msg.New(msg.TYPE_ERROR, err.Error())
+	}
+
+	summary := &RemoveSummary{DryRun: opts.dryRun}
+	var targets []string
+	var listing []string
+	for _, p := range paths {
+		full, entries, err := fs.removable(p, opts.recursive)
+		if err != nil {
+			summary.Results = append(summary.Results, RemoveResult{Path: p, Error: err.Error()})
+			continue
+		}
+		targets = append(targets, full)
+		listing = append(listing, entries...)
+		summary.Results = append(summary.Results, RemoveResult{Path: fs.display(full)})
+	}
+
+	if opts.recursive {
+		token := fs.removeToken(listing)
+		if opts.dryRun {
+			summary.Token = token
+		} else if !hmac.Equal([]byte(opts.token), []byte(token)) {
+			return msg.New(msg.TYPE_ERROR, "Removing directories needs --confirm with the token from --dry-run, run it again if anything changed")
+		}
+	}
+
+	i := 0
+	for r := range summary.Results {
+		result := &summary.Results[r]
+		if result.Error != "" {
+			continue
+		}
+		full := targets[i]
+		i++
+		info, err := os.Lstat(full)
+		if err != nil {
+			result.Error = ERR_NOT_FOUND
+			continue
+		}
+		result.Dir = info.IsDir()
+		result.Entries = 1
+		if opts.recursive && info.IsDir() {
+			result.Entries = countEntries(full)
+		}
+		if opts.dryRun {
+			continue
+		}
+		if result.Dir && !opts.recursive && !emptyDir(full) {
+			result.Error = "Directory is not empty, remove it with -r"
+			continue
+		}
+		if err = fs.trash(full); err != nil {
+			result.Error = err.Error()
+			continue
+		}
+		result.Removed = true
+	}
+
+	bys, err := json.Marshal(summary)
+	if err != nil {
+		return msg.New(msg.TYPE_ERROR, err.Error())
+	}
+	return msg.New(msg.TYPE_RESPONSE, string(bys))
+}
+
+// removable checks p may be removed and lists what would go with it, for the token
+func (fs *FSConfig) removable(p string, recursive bool) (full string, entries []string, err error) {
+	full, err = fs.resolve(p)
+	if err != nil {
+		return
+	}
+	root, err := fs.root()
+	if err != nil {
+		return
+	}
+	if full == root {
+		return "", nil, fmt.Errorf(PERM_DENIED)
+	}
+	info, err := os.Lstat(full)
+	if err != nil {
+		return "", nil, fmt.Errorf(ERR_NOT_FOUND)
+	}
+	if !info.IsDir() || !recursive {
+		return full, []string{describe(fs.display(full), info)}, nil
+	}
+	err = filepath.Walk(full, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fs.invisible(root, path, info.IsDir()) {
+			return fmt.Errorf("%s holds files that can't be removed: %s", fs.display(full), PERM_DENIED)
+		}
+		entries = append(entries, describe(fs.display(path), info))
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return
+}
+
+// replaceable fails if full holds invisible files, which overwriting it would send to the trash with it
+func (fs *FSConfig) replaceable(full string) error {
+	root, err := fs.root()
+	if err != nil {
+		return err
+	}
+	return filepath.Walk(full, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fs.invisible(root, path, info.IsDir()) {
+			return fmt.Errorf("%s holds files that can't be replaced: %s", fs.display(full), PERM_DENIED)
+		}
+		return nil
+	})
+}
+
+// describe is what the token covers for each entry
+func describe(p string, info os.FileInfo) string {
+	return fmt.Sprintf("%s\x00%v\x00%d\x00%d", p, info.Mode(), info.Size(), info.ModTime().UnixNano())
+}
+
+// removeToken signs a listing, so that a remove is confirmed for exactly what the dry run saw
+func (fs *FSConfig) removeToken(listing []string) string {
+	mac := hmac.New(sha256.New, fs.secret)
+	for _, entry := range listing {
+		mac.Write([]byte(entry))
+		mac.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func emptyDir(p string) bool {
+	list, err := ioutil.ReadDir(p)
+	return err == nil && len(list) == 0
+}
+
+func countEntries(p string) int {
+	n := 0
+	filepath.Walk(p, func(string, os.FileInfo, error) error {
+		n++
+		return nil
+	})
+	return n
+}
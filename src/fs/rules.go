@@ -0,0 +1,124 @@
+package fs
+
+import (
+	"path"
+	"strings"
+)
+
+// rule is one pattern of a rules list
+type rule struct {
+	// segments are the pattern split at slashes
+	segments []string
+	negate   bool
+	dirOnly  bool
+	// anchored patterns match paths from baseDir, the others match names at any depth
+	anchored bool
+}
+
+// rules decide what is invisible the way .gitignore does:
+//
+//	name, *.pem    names at any depth
+//	a/b, /name     paths from baseDir, a slash anywhere but the end anchors a pattern
+//	logs/          directories only
+//	a/**/b         ** stands for any number of directories
+//	!pattern       makes visible again what an earlier pattern hid
+//	# comment      blank lines and comments are skipped, \# and \! start patterns with those
+//
+// The last pattern matching a path wins, and everything in an invisible directory is invisible.
+type rules []rule
+
+func parseRules(patterns []string) (rules, error) {
+	var list rules
+	for _, p := range patterns {
+		p = strings.TrimRight(p, " ")
+		if p == "" || strings.HasPrefix(p, "#") {
+			continue
+		}
+		var r rule
+		if strings.HasPrefix(p, "!") {
+			r.negate = true
+			p = p[1:]
+		} else if strings.HasPrefix(p, `\!`) || strings.HasPrefix(p, `\#`) {
+			p = p[1:]
+		}
+		if strings.HasSuffix(p, "/") {
+			r.dirOnly = true
+			p = strings.TrimRight(p, "/")
+		}
+		r.anchored = strings.Contains(p, "/")
+		p = strings.TrimLeft(p, "/")
+		if p == "" {
+			continue
+		}
+		r.segments = strings.Split(p, "/")
+		for _, segment := range r.segments {
+			if _, err := path.Match(segment, ""); err != nil {
+				return nil, err
+			}
+		}
+		list = append(list, r)
+	}
+	return list, nil
+}
+
+// match tells whether rel, a slash separated path from baseDir, is hidden, dir telling whether it is a directory
+func (list rules) match(rel string, dir bool) bool {
+	if rel == "" || rel == "." {
+		return false
+	}
+	parts := strings.Split(rel, "/")
+	for i := range parts {
+		// An invisible directory can't be made visible again below
+		if list.hides(parts[:i+1], dir || i < len(parts)-1) {
+			return true
+		}
+	}
+	return false
+}
+
+// hides applies the rules to the path parts alone, without looking at the directories holding it
+func (list rules) hides(parts []string, dir bool) bool {
+	hidden := false
+	for _, r := range list {
+		if hidden != r.negate || (r.dirOnly && !dir) {
+			// Can't change the outcome
+			continue
+		}
+		var ok bool
+		if r.anchored {
+			ok = matchSegments(r.segments, parts)
+		} else {
+			ok, _ = path.Match(r.segments[0], parts[len(parts)-1])
+		}
+		if ok {
+			hidden = !r.negate
+		}
+	}
+	return hidden
+}
+
+// matchSegments matches path parts against pattern segments, ** standing for any number of parts.
+// A trailing ** needs at least one, so a/** hides what is in a but not a itself.
+func matchSegments(segments, parts []string) bool {
+	if len(segments) == 0 {
+		return len(parts) == 0
+	}
+	if segments[0] == "**" {
+		if len(segments) == 1 {
+			return len(parts) > 0
+		}
+		for i := 0; i <= len(parts); i++ {
+			if matchSegments(segments[1:], parts[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(parts) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(segments[0], parts[0]); !ok {
+		return false
+	}
+	return matchSegments(segments[1:], parts[1:])
+}
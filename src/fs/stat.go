@@ -0,0 +1,129 @@
+package fs
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	msg "github.com/miska12345/MiskaRFS/src/message"
+)
+
+// FileStat describes a single path
+type FileStat struct {
+	// Path is relative to baseDir
+	Path string
+	Name string
+	Size int64
+	Dir  bool
+	// Mode is in ls form, e.g. -rw-r--r--, Perm is its permission bits
+	Mode string
+	Perm uint32
+	// Uid and Gid are -1 where the platform doesn't have them
+	Uid int
+	Gid int
+	// Times are at full precision, ChangeTime and AccessTime are zero where the platform doesn't have them
+	ModTime    time.Time
+	ChangeTime time.Time
+	AccessTime time.Time
+	// Symlink is the target of a symbolic link
+	Symlink string `json:",omitempty"`
+	// MIME is sniffed from the first bytes of regular files
+	MIME string `json:",omitempty"`
+	// Hidden is set when the invisibleFiles patterns hide the path from clients. Only StatPath
+	// describes such paths, clients are told they aren't found, so it is never sent.
+	Hidden bool `json:"-"`
+}
+
+// How much of a file is read to tell its MIME type
+const sniffLength = 512
+
+// Stat describes a path, the current directory if none is given: stat [path].
+// Invisible paths aren't found.
+func (fs *FSConfig) Stat(args ...string) *msg.Message {
+	p := "."
+	if len(args) > 0 && args[0] != "" {
+		p = args[0]
+	}
+	full, err := fs.resolve(p)
+	if err != nil {
+		return msg.New(msg.TYPE_ERROR, err.Error())
+	}
+	st, err := fs.stat(full)
+	if err != nil {
+		return msg.New(msg.TYPE_ERROR, ERR_NOT_FOUND)
+	}
+	return jsonResponse(st)
+}
+
+// StatPath describes p as the host sees it, invisible files included.
+// Relative paths start at the current directory and absolute ones at baseDir.
+func (fs *FSConfig) StatPath(p string) (*FileStat, error) {
+	root, err := fs.root()
+	if err != nil {
+		return nil, err
+	}
+	var full string
+	if strings.HasPrefix(p, "/") {
+		full = filepath.Join(root, filepath.FromSlash(p))
+	} else {
+		cur, err := filepath.Abs(fs.currentDir())
+		if err != nil {
+			return nil, err
+		}
+		full = filepath.Join(cur, filepath.FromSlash(p))
+	}
+	if !within(root, full) {
+		return nil, fmt.Errorf(PERM_DENIED)
+	}
+	return fs.stat(full)
+}
+
+func (fs *FSConfig) stat(full string) (*FileStat, error) {
+	info, err := os.Lstat(full)
+	if err != nil {
+		return nil, err
+	}
+	root, err := fs.root()
+	if err != nil {
+		return nil, err
+	}
+	st := &FileStat{
+		Path:    fs.display(full),
+		Name:    info.Name(),
+		Size:    info.Size(),
+		Dir:     info.IsDir(),
+		Mode:    info.Mode().String(),
+		Perm:    uint32(info.Mode().Perm()),
+		Uid:     -1,
+		Gid:     -1,
+		ModTime: info.ModTime(),
+		Hidden:  fs.hidden(root, full),
+	}
+	platformStat(st, info)
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		st.Symlink, _ = os.Readlink(full)
+	case info.Mode().IsRegular():
+		st.MIME = sniff(full)
+	}
+	return st, nil
+}
+
+// sniff tells the MIME type of a file from its first bytes, empty if it can't be read
+func sniff(p string) string {
+	f, err := os.Open(p)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	buf := make([]byte, sniffLength)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return ""
+	}
+	return http.DetectContentType(buf[:n])
+}
@@ -0,0 +1,18 @@
+package fs
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+func platformStat(st *FileStat, info os.FileInfo) {
+	sys, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	st.Uid = int(sys.Uid)
+	st.Gid = int(sys.Gid)
+	st.ChangeTime = time.Unix(sys.Ctimespec.Unix())
+	st.AccessTime = time.Unix(sys.Atimespec.Unix())
+}
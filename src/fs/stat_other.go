@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package fs
+
+import "os"
+
+// Owners and the other times aren't portable, only ModTime is known here
+func platformStat(st *FileStat, info os.FileInfo) {}
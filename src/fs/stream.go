@@ -0,0 +1,60 @@
+package fs
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	msg "github.com/miska12345/MiskaRFS/src/message"
+)
+
+// errCancelled stops a streaming command when its client cancels it
+var errCancelled = fmt.Errorf("cancelled")
+
+func cancelled(cancel <-chan struct{}) bool {
+	select {
+	case <-cancel:
+		return true
+	default:
+		return false
+	}
+}
+
+// Results are streamed in parts of this many, or sooner if they come slowly
+const (
+	streamBatch    = 64
+	streamInterval = 200 * time.Millisecond
+)
+
+// batcher streams results in parts, each a JSON list
+type batcher struct {
+	send    func(*msg.Message) error
+	items   []interface{}
+	flushed time.Time
+}
+
+func newBatcher(send func(*msg.Message) error) *batcher {
+	return &batcher{send: send, flushed: time.Now()}
+}
+
+func (b *batcher) add(item interface{}) error {
+	b.items = append(b.items, item)
+	if len(b.items) >= streamBatch || time.Since(b.flushed) > streamInterval {
+		return b.flush()
+	}
+	return nil
+}
+
+// flush sends what has been added so far as one part
+func (b *batcher) flush() error {
+	b.flushed = time.Now()
+	if len(b.items) == 0 {
+		return nil
+	}
+	bys, err := json.Marshal(b.items)
+	if err != nil {
+		return err
+	}
+	b.items = b.items[:0]
+	return b.send(msg.New(msg.TYPE_STREAM, string(bys)))
+}
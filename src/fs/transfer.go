@@ -0,0 +1,435 @@
+package fs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	msg "github.com/miska12345/MiskaRFS/src/message"
+)
+
+// TransferEntry is a file or directory that was moved or copied
+type TransferEntry struct {
+	From string
+	To   string
+	Dir  bool
+	Size int64
+	// Skipped is set when the destination already existed and was left alone
+	Skipped bool
+}
+
+// TransferSummary is what Move and Copy send back, as JSON
+type TransferSummary struct {
+	Op      string
+	Entries []TransferEntry
+	Files   int
+	Dirs    int
+	Bytes   int64
+	Skipped int
+}
+
+func (s *TransferSummary) add(e TransferEntry) {
+	s.Entries = append(s.Entries, e)
+	switch {
+	case e.Skipped:
+		s.Skipped++
+	case e.Dir:
+		s.Dirs++
+	default:
+		s.Files++
+		s.Bytes += e.Size
+	}
+}
+
+// transferOptions come from the flags before the paths
+type transferOptions struct {
+	// overwrite replaces files at the destination, -f
+	overwrite bool
+	// noClobber leaves them alone, -n. Without either an existing file is an error.
+	noClobber bool
+}
+
+func parseTransferArgs(args []string) (opts transferOptions, paths []string, err error) {
+	for i, arg := range args {
+		if arg == "" {
+			continue
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			paths = append(paths, args[i:]...)
+			break
+		}
+		for _, flag := range arg[1:] {
+			switch flag {
+			case 'f':
+				opts.overwrite, opts.noClobber = true, false
+			case 'n':
+				opts.noClobber, opts.overwrite = true, false
+			case 'r', 'R':
+				// Directories are always copied whole
+			default:
+				return opts, nil, fmt.Errorf("Unknown option -%c", flag)
+			}
+		}
+	}
+	if len(paths) < 2 {
+		return opts, nil, fmt.Errorf("Need a source and a destination")
+	}
+	return
+}
+
+// plannedTransfer is one source and where it ends up
+type plannedTransfer struct {
+	from, to string
+	info     os.FileInfo
+}
+
+// planTransfers resolves sources and destination, the last path, through the sandbox.
+// Several sources need the destination to be a directory, a single one lands inside it if it is one.
+func (fs *FSConfig) planTransfers(paths []string) ([]plannedTransfer, error) {
+	dst, err := fs.resolve(paths[len(paths)-1])
+	if err != nil {
+		return nil, err
+	}
+	dstInfo, err := os.Stat(dst)
+	dstIsDir := err == nil && dstInfo.IsDir()
+	sources := paths[:len(paths)-1]
+	if len(sources) > 1 && !dstIsDir {
+		return nil, fmt.Errorf("%s is not a directory", paths[len(paths)-1])
+	}
+
+	var plan []plannedTransfer
+	for _, p := range sources {
+		src, err := fs.resolve(p)
+		if err != nil {
+			return nil, err
+		}
+		info, err := os.Lstat(src)
+		if err != nil {
+			return nil, fmt.Errorf(ERR_NOT_FOUND)
+		}
+		root, err := fs.root()
+		if err != nil {
+			return nil, err
+		}
+		if src == root {
+			return nil, fmt.Errorf(PERM_DENIED)
+		}
+		to := dst
+		if dstIsDir {
+			to = filepath.Join(dst, filepath.Base(src))
+		}
+		if to == src {
+			return nil, fmt.Errorf("%s and %s are the same", fs.display(src), fs.display(to))
+		}
+		if info.IsDir() && within(src, to) {
+			return nil, fmt.Errorf("Can't put %s inside itself", fs.display(src))
+		}
+		if fs.hidden(root, to) {
+			return nil, fmt.Errorf(PERM_DENIED)
+		}
+		plan = append(plan, plannedTransfer{from: src, to: to, info: info})
+	}
+	return plan, nil
+}
+
+// Move renames or moves files and directories: mv [-f|-n] <source>... <destination>
+func (fs *FSConfig) Move(args ...string) *msg.Message {
+	if fs.readOnly {
+		return msg.New(msg.TYPE_ERROR, PERM_DENIED)
+	}
+	opts, paths, err := parseTransferArgs(args)
+	if err != nil {
+		return msg.New(msg.TYPE_ERROR, err.Error())
+	}
+	plan, err := fs.planTransfers(paths)
+	if err != nil {
+		return msg.New(msg.TYPE_ERROR, err.Error())
+	}
+	summary := &TransferSummary{Op: "move"}
+	for _, t := range plan {
+		if err := fs.move(t, opts, summary); err != nil {
+			return transferError(summary, err)
+		}
+	}
+	return transferResult(summary)
+}
+
+func (fs *FSConfig) move(t plannedTransfer, opts transferOptions, summary *TransferSummary) error {
+	// A directory holding invisible files stays put, they would go wherever it went
+	var entries []TransferEntry
+	root, err := fs.root()
+	if err != nil {
+		return err
+	}
+	err = filepath.Walk(t.from, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fs.invisible(root, p, info.IsDir()) {
+			return fmt.Errorf("%s holds files that can't be moved: %s", fs.display(t.from), PERM_DENIED)
+		}
+		rel, _ := filepath.Rel(t.from, p)
+		to := filepath.Join(t.to, rel)
+		// Nor can anything be moved where it would turn invisible
+		if fs.invisible(root, to, info.IsDir()) {
+			return fmt.Errorf(PERM_DENIED)
+		}
+		entries = append(entries, fs.entry(p, to, info))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if existing, err := os.Lstat(t.to); err == nil {
+		switch {
+		case opts.noClobber:
+			e := fs.entry(t.from, t.to, t.info)
+			e.Skipped = true
+			summary.add(e)
+			return nil
+		case !opts.overwrite:
+			return fmt.Errorf("%s already exists", fs.display(t.to))
+		case existing.IsDir() != t.info.IsDir():
+			return fmt.Errorf("Can't replace %s with %s", fs.display(t.to), fs.display(t.from))
+		}
+		if err := fs.replaceable(t.to); err != nil {
+			return err
+		}
+		if err := fs.trash(t.to); err != nil {
+			return err
+		}
+	}
+
+	err = os.Rename(t.from, t.to)
+	if le, ok := err.(*os.LinkError); ok && le.Err == syscall.EXDEV {
+		// Another filesystem, copy it over and remove the original
+		copied := &TransferSummary{}
+		if err = fs.copyTree(t, transferOptions{overwrite: true}, copied); err == nil {
+			err = os.RemoveAll(t.from)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		summary.add(e)
+	}
+	return nil
+}
+
+// Copy copies files and directories, directories with everything in them:
+// cp [-r] [-f|-n] <source>... <destination>. Modes and modification times are kept.
+func (fs *FSConfig) Copy(args ...string) *msg.Message {
+	if fs.readOnly {
+		return msg.New(msg.TYPE_ERROR, PERM_DENIED)
+	}
+	opts, paths, err := parseTransferArgs(args)
+	if err != nil {
+		return msg.New(msg.TYPE_ERROR, err.Error())
+	}
+	plan, err := fs.planTransfers(paths)
+	if err != nil {
+		return msg.New(msg.TYPE_ERROR, err.Error())
+	}
+	if !opts.overwrite && !opts.noClobber {
+		// Find out about existing files before copying anything
+		for _, t := range plan {
+			if err := fs.checkClobber(t); err != nil {
+				return msg.New(msg.TYPE_ERROR, err.Error())
+			}
+		}
+	}
+	summary := &TransferSummary{Op: "copy"}
+	for _, t := range plan {
+		if err := fs.copyTree(t, opts, summary); err != nil {
+			return transferError(summary, err)
+		}
+	}
+	return transferResult(summary)
+}
+
+// checkClobber fails if copying t would replace anything
+func (fs *FSConfig) checkClobber(t plannedTransfer) error {
+	return fs.walkVisible(t.from, func(p string, info os.FileInfo) error {
+		rel, _ := filepath.Rel(t.from, p)
+		to := filepath.Join(t.to, rel)
+		existing, err := os.Lstat(to)
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() && existing.IsDir() {
+			// Merging directories is fine
+			return nil
+		}
+		return fmt.Errorf("%s already exists", fs.display(to))
+	})
+}
+
+// copyTree copies t.from to t.to, leaving out invisible files and refusing to write invisible ones
+func (fs *FSConfig) copyTree(t plannedTransfer, opts transferOptions, summary *TransferSummary) error {
+	root, err := fs.root()
+	if err != nil {
+		return err
+	}
+	var dirs []plannedTransfer
+	err = fs.walkVisible(t.from, func(p string, info os.FileInfo) error {
+		rel, _ := filepath.Rel(t.from, p)
+		to := filepath.Join(t.to, rel)
+		if fs.invisible(root, to, info.IsDir()) {
+			return fmt.Errorf(PERM_DENIED)
+		}
+		e := fs.entry(p, to, info)
+
+		existing, err := os.Lstat(to)
+		exists := err == nil
+		switch {
+		case info.IsDir():
+			if exists && !existing.IsDir() {
+				return fmt.Errorf("Can't replace %s with a directory", fs.display(to))
+			}
+			if !exists {
+				if err := os.Mkdir(to, info.Mode().Perm()|0700); err != nil {
+					return err
+				}
+			}
+			// Times and modes of directories are set once their contents are in
+			dirs = append(dirs, plannedTransfer{from: p, to: to, info: info})
+		case exists && opts.noClobber:
+			e.Skipped = true
+		case exists && existing.IsDir():
+			return fmt.Errorf("Can't replace directory %s with a file", fs.display(to))
+		case exists && !opts.overwrite:
+			return fmt.Errorf("%s already exists", fs.display(to))
+		default:
+			if exists {
+				if err := fs.replaceable(to); err != nil {
+					return err
+				}
+				if err := fs.trash(to); err != nil {
+					return err
+				}
+			}
+			if err := copyFile(p, to, info); err != nil {
+				return err
+			}
+		}
+		summary.add(e)
+		return nil
+	})
+	for i := len(dirs) - 1; i >= 0; i-- {
+		d := dirs[i]
+		os.Chmod(d.to, d.info.Mode().Perm())
+		os.Chtimes(d.to, d.info.ModTime(), d.info.ModTime())
+	}
+	return err
+}
+
+// copyFile copies a single file or symlink with its mode and modification time
+func copyFile(from, to string, info os.FileInfo) error {
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(from)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, to)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("Can't copy special file %s", filepath.Base(from))
+	}
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(to)
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	// The umask may have taken bits off
+	if err = os.Chmod(to, info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(to, info.ModTime(), info.ModTime())
+}
+
+// walkVisible walks the tree at p without following symlinks, leaving out invisible files
+func (fs *FSConfig) walkVisible(p string, fn func(p string, info os.FileInfo) error) error {
+	root, err := fs.root()
+	if err != nil {
+		return err
+	}
+	return filepath.Walk(p, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fs.invisible(root, p, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		return fn(p, info)
+	})
+}
+
+// walkReadable is walkVisible leaving out directories that can't be read instead of failing
+func (fs *FSConfig) walkReadable(p string, fn func(p string, info os.FileInfo) error) error {
+	root, err := fs.root()
+	if err != nil {
+		return err
+	}
+	return filepath.Walk(p, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Skipped the way find skips them
+			return nil
+		}
+		if fs.invisible(root, p, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		return fn(p, info)
+	})
+}
+
+func (fs *FSConfig) entry(from, to string, info os.FileInfo) TransferEntry {
+	e := TransferEntry{
+		From: fs.display(from),
+		To:   fs.display(to),
+		Dir:  info.IsDir(),
+	}
+	if !e.Dir {
+		e.Size = info.Size()
+	}
+	return e
+}
+
+func transferResult(summary *TransferSummary) *msg.Message {
+	bys, err := json.Marshal(summary)
+	if err != nil {
+		return msg.New(msg.TYPE_ERROR, err.Error())
+	}
+	return msg.New(msg.TYPE_RESPONSE, string(bys))
+}
+
+// transferError reports err along with whatever was done before it
+func transferError(summary *TransferSummary, err error) *msg.Message {
+	if len(summary.Entries) == 0 {
+		return msg.New(msg.TYPE_ERROR, err.Error())
+	}
+	return msg.New(msg.TYPE_ERROR, fmt.Sprintf("%s after %d files and %d directories", err, summary.Files, summary.Dirs))
+}
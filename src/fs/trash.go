@@ -0,0 +1,378 @@
+package fs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	msg "github.com/miska12345/MiskaRFS/src/message"
+)
+
+// TRASH_DIR is kept under baseDir and is always invisible
+const TRASH_DIR = ".miskarfs-trash"
+
+// Inside TRASH_DIR every item gets a directory named by its id holding these
+const (
+	trashData = "data"
+	trashInfo = "info.json"
+)
+
+// TrashPolicy purges the trash on its own, zero values mean never.
+// It is applied whenever the trash is used and, with a MaxAge, at least once a minute besides.
+type TrashPolicy struct {
+	// MaxAge purges items deleted longer ago than this
+	MaxAge time.Duration
+	// MaxSize purges the oldest items while the trash holds more bytes than this
+	MaxSize int64
+}
+
+// TrashItem is something removed or overwritten that can still be restored
+type TrashItem struct {
+	ID string
+	// Path is where it was, relative to baseDir
+	Path    string
+	Dir     bool
+	Size    int64
+	Deleted time.Time
+}
+
+// SetTrashPolicy sets when the trash purges itself, until Close
+func (fs *FSConfig) SetTrashPolicy(policy TrashPolicy) {
+	fs.trashLock.Lock()
+	defer fs.trashLock.Unlock()
+	fs.trashPolicy = policy
+	fs.stopPurging()
+	if policy.MaxAge > 0 {
+		// Items expire while nobody uses the trash too
+		every := policy.MaxAge
+		if every > time.Minute {
+			every = time.Minute
+		}
+		fs.purging = make(chan struct{})
+		go fs.purgeEvery(every, fs.purging)
+	}
+}
+
+// Close stops purging the trash in the background
+func (fs *FSConfig) Close() {
+	fs.trashLock.Lock()
+	fs.stopPurging()
+	fs.trashLock.Unlock()
+}
+
+// stopPurging is Close for callers holding the lock
+func (fs *FSConfig) stopPurging() {
+	if fs.purging != nil {
+		close(fs.purging)
+		fs.purging = nil
+	}
+}
+
+// purgeEvery applies the policy every so often until stop is closed
+func (fs *FSConfig) purgeEvery(every time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		fs.trashLock.Lock()
+		fs.purgeExpired()
+		fs.trashLock.Unlock()
+	}
+}
+
+func (fs *FSConfig) trashDir() (string, error) {
+	root, err := fs.root()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(root, TRASH_DIR), nil
+}
+
+// trash moves full into the trash instead of deleting it
+func (fs *FSConfig) trash(full string) error {
+	fs.trashLock.Lock()
+	defer fs.trashLock.Unlock()
+	if err := fs.trashLocked(full); err != nil {
+		return err
+	}
+	fs.purgeExpired()
+	return nil
+}
+
+// trashLocked is trash for callers holding the lock
+func (fs *FSConfig) trashLocked(full string) error {
+	info, err := os.Lstat(full)
+	if err != nil {
+		return err
+	}
+	dir, err := fs.trashDir()
+	if err != nil {
+		return err
+	}
+	id := make([]byte, 4)
+	if _, err = rand.Read(id); err != nil {
+		return err
+	}
+	item := TrashItem{
+		// Ids sort by deletion time
+		ID:      fmt.Sprintf("%d-%s", time.Now().UnixNano(), hex.EncodeToString(id)),
+		Path:    fs.display(full),
+		Dir:     info.IsDir(),
+		Size:    treeSize(full),
+		Deleted: time.Now(),
+	}
+
+	itemDir := filepath.Join(dir, item.ID)
+	if err = os.MkdirAll(itemDir, 0700); err != nil {
+		return err
+	}
+	bys, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(filepath.Join(itemDir, trashInfo), bys, 0600); err != nil {
+		os.RemoveAll(itemDir)
+		return err
+	}
+	if err = relocate(full, filepath.Join(itemDir, trashData), info); err != nil {
+		os.RemoveAll(itemDir)
+		return err
+	}
+	return nil
+}
+
+// relocate renames from to to, copying across filesystems when it has to
+func relocate(from, to string, info os.FileInfo) error {
+	err := os.Rename(from, to)
+	if le, ok := err.(*os.LinkError); !ok || le.Err != syscall.EXDEV {
+		return err
+	}
+	err = filepath.Walk(from, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(from, p)
+		if info.IsDir() {
+			return os.Mkdir(filepath.Join(to, rel), info.Mode().Perm()|0700)
+		}
+		return copyFile(p, filepath.Join(to, rel), info)
+	})
+	if err != nil {
+		os.RemoveAll(to)
+		return err
+	}
+	return os.RemoveAll(from)
+}
+
+func treeSize(p string) (size int64) {
+	filepath.Walk(p, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return
+}
+
+// trashItems lists the trash oldest first, the caller must hold the lock
+func (fs *FSConfig) trashItems() ([]TrashItem, error) {
+	dir, err := fs.trashDir()
+	if err != nil {
+		return nil, err
+	}
+	list, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []TrashItem{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	items := []TrashItem{}
+	for _, entry := range list {
+		bys, err := ioutil.ReadFile(filepath.Join(dir, entry.Name(), trashInfo))
+		if err != nil {
+			continue
+		}
+		var item TrashItem
+		if json.Unmarshal(bys, &item) != nil || item.ID != entry.Name() {
+			continue
+		}
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Deleted.Before(items[j].Deleted)
+	})
+	return items, nil
+}
+
+// purgeExpired applies the policy, the caller must hold the lock
+func (fs *FSConfig) purgeExpired() {
+	policy := fs.trashPolicy
+	if policy.MaxAge <= 0 && policy.MaxSize <= 0 {
+		return
+	}
+	items, err := fs.trashItems()
+	if err != nil {
+		return
+	}
+	var total int64
+	for _, item := range items {
+		total += item.Size
+	}
+	for _, item := range items {
+		expired := policy.MaxAge > 0 && time.Since(item.Deleted) > policy.MaxAge
+		tooBig := policy.MaxSize > 0 && total > policy.MaxSize
+		if !expired && !tooBig {
+			break
+		}
+		if fs.purge(item.ID) == nil {
+			total -= item.Size
+		}
+	}
+}
+
+func (fs *FSConfig) purge(id string) error {
+	dir, err := fs.trashDir()
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(dir, id))
+}
+
+// Trash manages removed and overwritten files:
+// trash ls, trash restore [-f] <id> [destination], trash purge [id...]
+func (fs *FSConfig) Trash(args ...string) *msg.Message {
+	if len(args) == 0 {
+		args = []string{"ls"}
+	}
+	if args[0] != "ls" && fs.readOnly {
+		return msg.New(msg.TYPE_ERROR, PERM_DENIED)
+	}
+	fs.trashLock.Lock()
+	defer fs.trashLock.Unlock()
+	fs.purgeExpired()
+
+	switch args[0] {
+	case "ls":
+		items, err := fs.trashItems()
+		if err != nil {
+			return msg.New(msg.TYPE_ERROR, err.Error())
+		}
+		return jsonResponse(items)
+	case "restore":
+		return fs.restore(args[1:])
+	case "purge":
+		items, err := fs.trashItems()
+		if err != nil {
+			return msg.New(msg.TYPE_ERROR, err.Error())
+		}
+		ids := make(map[string]bool)
+		for _, id := range args[1:] {
+			ids[id] = true
+		}
+		purged := []TrashItem{}
+		for _, item := range items {
+			if len(ids) > 0 && !ids[item.ID] {
+				continue
+			}
+			if err := fs.purge(item.ID); err != nil {
+				return msg.New(msg.TYPE_ERROR, err.Error())
+			}
+			delete(ids, item.ID)
+			purged = append(purged, item)
+		}
+		for id := range ids {
+			return msg.New(msg.TYPE_ERROR, fmt.Sprintf("No %s in the trash", id))
+		}
+		return jsonResponse(purged)
+	}
+	return msg.New(msg.TYPE_ERROR, fmt.Sprintf("Unknown trash command %s", args[0]))
+}
+
+// restore puts an item back where it was, or at a destination, the caller must hold the lock
+func (fs *FSConfig) restore(args []string) *msg.Message {
+	overwrite := false
+	if len(args) > 0 && args[0] == "-f" {
+		overwrite = true
+		args = args[1:]
+	}
+	if len(args) == 0 || len(args) > 2 {
+		return msg.New(msg.TYPE_ERROR, "trash restore [-f] <id> [destination]")
+	}
+	id := args[0]
+	if strings.ContainsAny(id, `/\`) || id == "." || id == ".." {
+		return msg.New(msg.TYPE_ERROR, fmt.Sprintf("No %s in the trash", id))
+	}
+	items, err := fs.trashItems()
+	if err != nil {
+		return msg.New(msg.TYPE_ERROR, err.Error())
+	}
+	var item *TrashItem
+	for i := range items {
+		if items[i].ID == id {
+			item = &items[i]
+		}
+	}
+	if item == nil {
+		return msg.New(msg.TYPE_ERROR, fmt.Sprintf("No %s in the trash", id))
+	}
+
+	destination := item.Path
+	if len(args) == 2 {
+		destination = args[1]
+	}
+	to, err := fs.resolve(destination)
+	if err != nil {
+		return msg.New(msg.TYPE_ERROR, err.Error())
+	}
+	if existing, err := os.Lstat(to); err == nil {
+		if !overwrite {
+			return msg.New(msg.TYPE_ERROR, fmt.Sprintf("%s already exists", fs.display(to)))
+		}
+		if existing.IsDir() {
+			return msg.New(msg.TYPE_ERROR, fmt.Sprintf("Can't replace directory %s", fs.display(to)))
+		}
+		// What was there goes to the trash in turn
+		if err := fs.trashLocked(to); err != nil {
+			return msg.New(msg.TYPE_ERROR, err.Error())
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return msg.New(msg.TYPE_ERROR, err.Error())
+	}
+	dir, err := fs.trashDir()
+	if err != nil {
+		return msg.New(msg.TYPE_ERROR, err.Error())
+	}
+	data := filepath.Join(dir, id, trashData)
+	info, err := os.Lstat(data)
+	if err != nil {
+		return msg.New(msg.TYPE_ERROR, err.Error())
+	}
+	if err := relocate(data, to, info); err != nil {
+		return msg.New(msg.TYPE_ERROR, err.Error())
+	}
+	fs.purge(id)
+	item.Path = fs.display(to)
+	return jsonResponse(item)
+}
+
+func jsonResponse(v interface{}) *msg.Message {
+	bys, err := json.Marshal(v)
+	if err != nil {
+		return msg.New(msg.TYPE_ERROR, err.Error())
+	}
+	return msg.New(msg.TYPE_RESPONSE, string(bys))
+}
@@ -0,0 +1,197 @@
+package fs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	msg "github.com/miska12345/MiskaRFS/src/message"
+)
+
+// DirUsage is what a directory holds, everything below it counted
+type DirUsage struct {
+	Path  string
+	Size  int64
+	Files int
+	Dirs  int
+	// Children are its subdirectories, down to the depth asked for
+	Children []*DirUsage `json:",omitempty"`
+}
+
+// dirListing is what a directory holds itself, the visible names in it without going into subdirectories
+type dirListing struct {
+	modTime time.Time
+	files   []string
+	dirs    []string
+}
+
+// dirCache keeps listings until their directory's mtime changes, sparing repeated calls reading every
+// directory and matching every name against the invisibility rules. Files changing size in place don't
+// touch the mtime, so sizes aren't kept: every call still looks up each file and directory it counts.
+type dirCache struct {
+	listings map[string]*dirListing
+	sync.Mutex
+}
+
+// Beyond this many directories the cache starts forgetting
+const maxCachedDirs = 10000
+
+// listing returns what the directory p holds, from the cache while p hasn't changed
+func (fs *FSConfig) listing(p string, info os.FileInfo) (*dirListing, error) {
+	fs.dirCache.Lock()
+	l, ok := fs.dirCache.listings[p]
+	fs.dirCache.Unlock()
+	if ok && l.modTime.Equal(info.ModTime()) {
+		return l, nil
+	}
+
+	list, err := ioutil.ReadDir(p)
+	if err != nil {
+		return nil, err
+	}
+	root, err := fs.root()
+	if err != nil {
+		return nil, err
+	}
+	l = &dirListing{modTime: info.ModTime()}
+	for _, entry := range list {
+		if fs.invisible(root, filepath.Join(p, entry.Name()), entry.IsDir()) {
+			continue
+		}
+		if entry.IsDir() {
+			l.dirs = append(l.dirs, entry.Name())
+		} else {
+			l.files = append(l.files, entry.Name())
+		}
+	}
+
+	fs.dirCache.Lock()
+	if fs.dirCache.listings == nil {
+		fs.dirCache.listings = make(map[string]*dirListing)
+	}
+	if len(fs.dirCache.listings) >= maxCachedDirs {
+		for k := range fs.dirCache.listings {
+			delete(fs.dirCache.listings, k)
+			if len(fs.dirCache.listings) < maxCachedDirs/2 {
+				break
+			}
+		}
+	}
+	fs.dirCache.listings[p] = l
+	fs.dirCache.Unlock()
+	return l, nil
+}
+
+// usage adds up everything under p, keeping children down to limit levels below it, all of them if limit is negative
+func (fs *FSConfig) usage(p string, depth, limit int) (*DirUsage, error) {
+	info, err := os.Lstat(p)
+	if err != nil {
+		return nil, err
+	}
+	u := &DirUsage{Path: fs.display(p)}
+	if !info.IsDir() {
+		u.Size, u.Files = info.Size(), 1
+		return u, nil
+	}
+	l, err := fs.listing(p, info)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range l.files {
+		file, err := os.Lstat(filepath.Join(p, name))
+		if err != nil {
+			// Removed since, the directory will be listed again next time
+			continue
+		}
+		u.Size += file.Size()
+		u.Files++
+	}
+	for _, name := range l.dirs {
+		child, err := fs.usage(filepath.Join(p, name), depth+1, limit)
+		if err != nil {
+			// Gone or unreadable, leave it out
+			continue
+		}
+		u.Size += child.Size
+		u.Files += child.Files
+		u.Dirs += 1 + child.Dirs
+		if limit < 0 || depth < limit {
+			u.Children = append(u.Children, child)
+		}
+	}
+	return u, nil
+}
+
+// parseUsage reads: [path] [-d depth], depth is the default
+func parseUsage(args []string, depth int) (string, int, error) {
+	p := "."
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; arg {
+		case "":
+		case "-d":
+			if i+1 == len(args) {
+				return p, depth, fmt.Errorf("-d needs a depth")
+			}
+			i++
+			d, err := strconv.Atoi(args[i])
+			if err != nil || d < 0 {
+				return p, depth, fmt.Errorf("-d is a number of levels")
+			}
+			depth = d
+		default:
+			p = arg
+		}
+	}
+	return p, depth, nil
+}
+
+// Tree shows the directories under the current directory, or the path given, two levels deep unless
+// told otherwise, with what each holds: tree [path] [-d depth]. See dirCache for what repeating it saves.
+func (fs *FSConfig) Tree(args ...string) *msg.Message {
+	p, depth, err := parseUsage(args, 2)
+	if err != nil {
+		return msg.New(msg.TYPE_ERROR, err.Error())
+	}
+	full, err := fs.resolve(p)
+	if err != nil {
+		return msg.New(msg.TYPE_ERROR, err.Error())
+	}
+	u, err := fs.usage(full, 0, depth)
+	if err != nil {
+		return msg.New(msg.TYPE_ERROR, ERR_NOT_FOUND)
+	}
+	return jsonResponse(u)
+}
+
+// DiskUsage lists the size and file count of the current directory, or the path given, and of
+// its subdirectories one level deep unless told otherwise: du [path] [-d depth]
+func (fs *FSConfig) DiskUsage(args ...string) *msg.Message {
+	p, depth, err := parseUsage(args, 1)
+	if err != nil {
+		return msg.New(msg.TYPE_ERROR, err.Error())
+	}
+	full, err := fs.resolve(p)
+	if err != nil {
+		return msg.New(msg.TYPE_ERROR, err.Error())
+	}
+	u, err := fs.usage(full, 0, depth)
+	if err != nil {
+		return msg.New(msg.TYPE_ERROR, ERR_NOT_FOUND)
+	}
+	// Flat, deepest first like du
+	list := []*DirUsage{}
+	var flatten func(u *DirUsage)
+	flatten = func(u *DirUsage) {
+		for _, child := range u.Children {
+			flatten(child)
+		}
+		u.Children = nil
+		list = append(list, u)
+	}
+	flatten(u)
+	return jsonResponse(list)
+}
@@ -0,0 +1,181 @@
+package fs
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	msg "github.com/miska12345/MiskaRFS/src/message"
+)
+
+// What a WatchEvent reports
+const (
+	WATCH_CREATE = "create"
+	WATCH_WRITE  = "write"
+	WATCH_REMOVE = "remove"
+	WATCH_RENAME = "rename"
+	// WATCH_OVERFLOW means events were lost and whatever is being shown should be listed again
+	WATCH_OVERFLOW = "overflow"
+)
+
+// WatchEvent is a change under a watched path
+type WatchEvent struct {
+	Path string
+	Op   string
+	// From is where a renamed path was before
+	From string `json:",omitempty"`
+	Dir  bool   `json:",omitempty"`
+}
+
+// WatchSummary is the last part of a watch
+type WatchSummary struct {
+	Events int
+	// Polling is set when changes were found by polling instead of being notified of
+	Polling bool
+}
+
+// watchPoll is how often the polling fallback looks for changes
+var watchPoll = time.Second
+
+// Watch sends changes to files and directories under the current directory, or the path given, as they
+// happen until cancel is closed: watch [path]. Changes to invisible files aren't sent.
+// Paths are shown with symlinks on the way resolved, a symlink itself can't be watched.
+func (fs *FSConfig) Watch(send func(*msg.Message) error, cancel <-chan struct{}, args ...string) *msg.Message {
+	p := "."
+	for _, arg := range args {
+		if arg == "" {
+			continue
+		}
+		if p != "." {
+			return msg.New(msg.TYPE_ERROR, "watch [path]")
+		}
+		p = arg
+	}
+	root, err := fs.resolve(p)
+	if err != nil {
+		return msg.New(msg.TYPE_ERROR, err.Error())
+	}
+	info, err := os.Lstat(root)
+	if err != nil {
+		return msg.New(msg.TYPE_ERROR, ERR_NOT_FOUND)
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return msg.New(msg.TYPE_ERROR, fmt.Sprintf("%s is a symlink, watch where it leads instead", p))
+	}
+	// Directories on the way there may be symlinks. Changes are looked for where they really are,
+	// so that the invisibility rules see the paths they are written for.
+	if root, err = filepath.EvalSymlinks(root); err != nil {
+		return msg.New(msg.TYPE_ERROR, ERR_NOT_FOUND)
+	}
+
+	events := make(chan WatchEvent, streamBatch)
+	stop := make(chan struct{})
+	defer close(stop)
+	emit := func(e WatchEvent) bool {
+		select {
+		case events <- e:
+			return true
+		case <-stop:
+			return false
+		}
+	}
+	// Changes are looked for before Watch goes on, so none made after it is called are missed
+	summary := &WatchSummary{}
+	if n, err := fs.startNotify(root); err == nil {
+		go n.run(emit, stop)
+	} else {
+		summary.Polling = true
+		last, _ := fs.snapshot(root)
+		go fs.poll(root, last, emit, stop)
+	}
+
+	results := newBatcher(send)
+	ticker := time.NewTicker(streamInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case e := <-events:
+			summary.Events++
+			err = results.add(e)
+		case <-ticker.C:
+			err = results.flush()
+		case <-cancel:
+			bys, err := json.Marshal(summary)
+			if err != nil {
+				return msg.New(msg.TYPE_ERROR, err.Error())
+			}
+			return msg.New(msg.TYPE_RESPONSE, string(bys))
+		}
+		if err != nil {
+			return msg.New(msg.TYPE_ERROR, err.Error())
+		}
+	}
+}
+
+// fileState is what polling compares to find changes
+type fileState struct {
+	dir     bool
+	size    int64
+	modTime time.Time
+}
+
+// snapshot records the state of everything visible under root
+func (fs *FSConfig) snapshot(root string) (map[string]fileState, error) {
+	files := make(map[string]fileState)
+	err := fs.walkVisible(root, func(p string, info os.FileInfo) error {
+		files[p] = fileState{dir: info.IsDir(), size: info.Size(), modTime: info.ModTime()}
+		return nil
+	})
+	return files, err
+}
+
+// poll compares what is under root to last every watchPoll until stop is closed.
+// Renames show up as a remove and a create.
+func (fs *FSConfig) poll(root string, last map[string]fileState, emit func(WatchEvent) bool, stop <-chan struct{}) {
+	ticker := time.NewTicker(watchPoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		now, err := fs.snapshot(root)
+		if err != nil {
+			// Something changed while walking, look again next time
+			continue
+		}
+		for p, state := range now {
+			before, ok := last[p]
+			switch {
+			case !ok || before.dir != state.dir:
+				if ok && !emit(WatchEvent{Path: fs.display(p), Op: WATCH_REMOVE, Dir: before.dir}) {
+					return
+				}
+				if !emit(WatchEvent{Path: fs.display(p), Op: WATCH_CREATE, Dir: state.dir}) {
+					return
+				}
+			case !state.dir && (before.size != state.size || !before.modTime.Equal(state.modTime)):
+				if !emit(WatchEvent{Path: fs.display(p), Op: WATCH_WRITE}) {
+					return
+				}
+			}
+		}
+		for p, state := range last {
+			if _, ok := now[p]; !ok && !emit(WatchEvent{Path: fs.display(p), Op: WATCH_REMOVE, Dir: state.dir}) {
+				return
+			}
+		}
+		last = now
+	}
+}
+
+// notifier sends changes the system tells it about until stop is closed
+type notifier interface {
+	run(emit func(WatchEvent) bool, stop <-chan struct{})
+}
+
+// errNoNotify is startNotify's error where the system can't tell about changes
+var errNoNotify = fmt.Errorf("change notifications aren't supported here")
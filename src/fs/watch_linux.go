@@ -0,0 +1,231 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// inotifyMask has IN_DONT_FOLLOW so that a symlink never gets where it leads watched
+const inotifyMask = unix.IN_CREATE | unix.IN_MODIFY | unix.IN_DELETE | unix.IN_DELETE_SELF |
+	unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_DONT_FOLLOW
+
+// inotify watches every visible directory under root, or root alone if it is a file
+type inotify struct {
+	fs   *FSConfig
+	fd   int
+	root string
+	// base is baseDir as fs.root has it
+	base string
+	// paths are the watched paths by watch descriptor
+	paths map[int]string
+	// moved are paths renamed away by cookie, until where they went turns up
+	moved map[uint32]WatchEvent
+}
+
+func (fs *FSConfig) startNotify(root string) (notifier, error) {
+	base, err := fs.root()
+	if err != nil {
+		return nil, err
+	}
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	n := &inotify{
+		fs:    fs,
+		fd:    fd,
+		root:  root,
+		base:  base,
+		paths: make(map[int]string),
+		moved: make(map[uint32]WatchEvent),
+	}
+	if err = n.add(root, nil); err != nil {
+		// Most likely out of watches, polling has no such limit
+		unix.Close(fd)
+		return nil, err
+	}
+	return n, nil
+}
+
+// add watches p and the visible directories under it, reporting what is already in them as created when emit is set
+func (n *inotify) add(p string, emit func(WatchEvent) bool) error {
+	return n.fs.walkVisible(p, func(q string, info os.FileInfo) error {
+		if emit != nil && q != p && !emit(WatchEvent{Path: n.fs.display(q), Op: WATCH_CREATE, Dir: info.IsDir()}) {
+			return errCancelled
+		}
+		if !info.IsDir() && q != n.root {
+			return nil
+		}
+		wd, err := unix.InotifyAddWatch(n.fd, q, inotifyMask)
+		if err != nil {
+			return err
+		}
+		n.paths[wd] = q
+		return nil
+	})
+}
+
+func (n *inotify) run(emit func(WatchEvent) bool, stop <-chan struct{}) {
+	defer unix.Close(n.fd)
+	buf := make([]byte, 64<<10)
+	fds := []unix.PollFd{{Fd: int32(n.fd), Events: unix.POLLIN}}
+	for !cancelled(stop) {
+		ready, err := unix.Poll(fds, int(streamInterval/time.Millisecond))
+		if err == unix.EINTR || (err == nil && ready == 0) {
+			continue
+		}
+		count := 0
+		if err == nil {
+			count, err = unix.Read(n.fd, buf)
+		}
+		if err == unix.EAGAIN {
+			continue
+		}
+		if err != nil {
+			// Carry on by polling, whatever happened in between is lost
+			if emit(WatchEvent{Path: n.fs.display(n.root), Op: WATCH_OVERFLOW}) {
+				last, _ := n.fs.snapshot(n.root)
+				n.fs.poll(n.root, last, emit, stop)
+			}
+			return
+		}
+		if !n.handle(buf[:count], emit) {
+			return
+		}
+	}
+}
+
+// handle reports the events in buf, returning false once emit does
+func (n *inotify) handle(buf []byte, emit func(WatchEvent) bool) bool {
+	for offset := 0; offset+unix.SizeofInotifyEvent <= len(buf); {
+		e := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+		start := offset + unix.SizeofInotifyEvent
+		offset = start + int(e.Len)
+		if offset > len(buf) {
+			break
+		}
+		name := strings.TrimRight(string(buf[start:offset]), "\x00")
+
+		if e.Mask&unix.IN_Q_OVERFLOW != 0 {
+			if !emit(WatchEvent{Path: n.fs.display(n.root), Op: WATCH_OVERFLOW}) {
+				return false
+			}
+			continue
+		}
+		dir, ok := n.paths[int(e.Wd)]
+		if !ok {
+			continue
+		}
+		if e.Mask&unix.IN_IGNORED != 0 {
+			delete(n.paths, int(e.Wd))
+			continue
+		}
+		p := dir
+		if name != "" {
+			p = filepath.Join(dir, name)
+		}
+		event := WatchEvent{Path: n.fs.display(p), Dir: e.Mask&unix.IN_ISDIR != 0}
+		if n.fs.invisible(n.base, p, event.Dir) {
+			// Renamed to something invisible is as good as gone
+			if from, ok := n.moved[e.Cookie]; ok && e.Mask&unix.IN_MOVED_TO != 0 {
+				delete(n.moved, e.Cookie)
+				n.forget(from.Path)
+				from.Op = WATCH_REMOVE
+				if !emit(from) {
+					return false
+				}
+			}
+			continue
+		}
+
+		switch {
+		case e.Mask&unix.IN_CREATE != 0:
+			event.Op = WATCH_CREATE
+		case e.Mask&unix.IN_MODIFY != 0 && !event.Dir:
+			event.Op = WATCH_WRITE
+		case e.Mask&unix.IN_DELETE != 0:
+			event.Op = WATCH_REMOVE
+		case e.Mask&unix.IN_DELETE_SELF != 0 && p == n.root:
+			// Below root, removals are reported by the parent
+			event.Op = WATCH_REMOVE
+		case e.Mask&unix.IN_MOVED_FROM != 0:
+			n.moved[e.Cookie] = event
+			continue
+		case e.Mask&unix.IN_MOVED_TO != 0:
+			from, ok := n.moved[e.Cookie]
+			if !ok {
+				// Moved in from elsewhere
+				event.Op = WATCH_CREATE
+				break
+			}
+			delete(n.moved, e.Cookie)
+			event.Op = WATCH_RENAME
+			event.From = from.Path
+			if event.Dir {
+				n.rename(from.Path, event.Path)
+			}
+			if !emit(event) {
+				return false
+			}
+			continue
+		default:
+			continue
+		}
+		if !emit(event) {
+			return false
+		}
+		if event.Op == WATCH_CREATE && event.Dir {
+			if err := n.add(p, emit); err == errCancelled {
+				return false
+			} else if err == unix.ENOSPC && !emit(WatchEvent{Path: event.Path, Op: WATCH_OVERFLOW}) {
+				return false
+			}
+		}
+	}
+
+	// Whatever was renamed away without turning up again went out of root
+	for cookie, from := range n.moved {
+		delete(n.moved, cookie)
+		n.forget(from.Path)
+		from.Op = WATCH_REMOVE
+		if !emit(from) {
+			return false
+		}
+	}
+	return true
+}
+
+// under tells whether the watched path p is at or under the displayed path d
+func (n *inotify) under(p, d string) bool {
+	shown := n.fs.display(p)
+	return shown == d || strings.HasPrefix(shown, d+"/")
+}
+
+// rename moves the watches at or under the displayed path from to to
+func (n *inotify) rename(from, to string) {
+	root, err := n.fs.root()
+	if err != nil {
+		return
+	}
+	for wd, p := range n.paths {
+		if n.under(p, from) {
+			rel := strings.TrimPrefix(n.fs.display(p), from)
+			n.paths[wd] = filepath.Join(root, filepath.FromSlash(to+rel))
+		}
+	}
+}
+
+// forget stops watching at or under the displayed path d
+func (n *inotify) forget(d string) {
+	for wd, p := range n.paths {
+		if n.under(p, d) {
+			unix.InotifyRmWatch(n.fd, uint32(wd))
+			delete(n.paths, wd)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package fs
+
+func (fs *FSConfig) startNotify(root string) (notifier, error) {
+	return nil, errNoNotify
+}
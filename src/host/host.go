@@ -5,54 +5,155 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/miska12345/MiskaRFS/src/comm"
+	"github.com/miska12345/MiskaRFS/src/discovery"
 	"github.com/miska12345/MiskaRFS/src/fs"
+	"github.com/miska12345/MiskaRFS/src/identity"
 	log "github.com/miska12345/MiskaRFS/src/logger"
 	msg "github.com/miska12345/MiskaRFS/src/message"
+	"github.com/miska12345/MiskaRFS/src/metrics"
+	"github.com/miska12345/MiskaRFS/src/p2p"
 	"github.com/miska12345/MiskaRFS/src/tcp2"
 )
 
 type Host struct {
 	fs                 *fs.FSConfig
+	identity           *identity.Identity
 	Features           map[string]func(args ...string) *msg.Message
 	Name               string
 	Pass               string
 	CurrentConnections int
+	relay              string
+	transport          comm.Transport
+	public             bool
+	direct             *p2p.Peer
+	// stop is closed to shut the host down, see ModuleConfig.Stop
+	stop <-chan struct{}
+	// Streams are features that send their results in parts as they go, until cancel is closed.
+	// What they return is the last part.
+	Streams map[string]func(send func(*msg.Message) error, cancel <-chan struct{}, args ...string) *msg.Message
+	// fsFeatures and fsStreams work on the file system as each session sees it, from its own directory
+	fsFeatures map[string]func(fs *fs.FSConfig, args ...string) *msg.Message
+	fsStreams  map[string]func(fs *fs.FSConfig, send func(*msg.Message) error, cancel <-chan struct{}, args ...string) *msg.Message
 	sync.Mutex
 }
 
 type client struct {
-	Comm *comm.Comm
 	Req  Request
+	sess *session
+	// generation tells the client apart from those the session has after it
+	generation int
+}
+
+// send replies to the request of the client, unless it has left the session
+func (c *client) send(m *msg.Message) error {
+	reply := *m
+	reply.ID = c.Req.ID
+	return c.sess.reply(c.generation, &reply)
 }
 
 type Request struct {
 	Type string
 	Body string
+	// ID names a request so that its responses can be told apart and its streamed response cancelled.
+	// The host makes one up for requests without.
+	ID string `json:",omitempty"`
 }
 
 type ModuleConfig struct {
-	Name           string
-	BaseDir        string
+	Name    string
+	BaseDir string
+	// InvisibleFiles are gitignore-style patterns for what clients can't see or touch, like secrets/*.pem or /tcp2/
 	InvisibleFiles []string
 	ReadOnly       bool
 	AddFeatures    map[string]func(args ...string) *msg.Message
+	// Trash purges removed and overwritten files on its own, they are kept until purged by default
+	Trash fs.TrashPolicy
+	// IdentityFile is where the host key is kept, defaults to ~/.miskarfs/host_ed25519
+	IdentityFile string
+	// Relay is the address of the relay, defaults to localhost:8080
+	Relay    string
+	Password string
+	// Public lists the host in the relay's room listing, hosts are unlisted by default
+	Public bool
+	// MetricsAddress serves Prometheus metrics at /metrics, e.g. 127.0.0.1:9101
+	MetricsAddress string
+	// Transport reaches the relay, defaults to WebSocket for ws:// and wss:// addresses and TCP otherwise
+	Transport comm.Transport
+	// Direct is an address to accept direct connections from clients on, e.g. :0.
+	// Clients that manage to reach it stop going through the relay.
+	Direct string
+	// Listen is an address the host accepts clients on itself, e.g. :9000 behind a forwarded port.
+	// Clients reach it the way they reach a relay, with the same password.
+	Listen string
+	// ListenTransport serves Listen, defaults to WebSocket for ws:// addresses and TCP otherwise
+	ListenTransport comm.Transport
+	// ListenLimits protect Listen the way tcp2.Config.Limits protect a relay, DefaultListenLimits if zero
+	ListenLimits tcp2.Limits
+	// LAN announces the host on the local network, accepting clients on Listen or any free port.
+	// A host with Listen or LAN and no Relay doesn't use a relay at all.
+	LAN bool
+	// Discovery picks where the host is announced, the defaults suit most networks
+	Discovery *discovery.Config
+	// Stop shuts the host down once closed, dropping its clients. Run returns when it has.
+	Stop <-chan struct{}
 }
 
 const ERR_REQUEST = -1
 
+// DefaultListenLimits leave room for a handful of users while slowing down anyone guessing the password
+var DefaultListenLimits = tcp2.Limits{
+	MaxConnections:       256,
+	MaxConnectionsPerIP:  32,
+	HandshakesPerSecond:  5,
+	HandshakeBurst:       20,
+	BanAfterBadPasswords: 10,
+	BanDuration:          10 * time.Minute,
+}
+
 // Run starts the host on this machine with the given configuration
 func Run(modConfig *ModuleConfig) (h *Host, err error) {
 	h = new(Host)
 	h.Name = modConfig.Name
+	h.Pass = modConfig.Password
+	h.relay = modConfig.Relay
+	if h.relay == "" && modConfig.Listen == "" && !modConfig.LAN {
+		h.relay = "localhost:8080"
+	}
+	h.public = modConfig.Public
+	h.stop = modConfig.Stop
+	h.transport = modConfig.Transport
+	if h.transport == nil {
+		h.transport = comm.TransportFor(h.relay)
+	}
+	identityFile := modConfig.IdentityFile
+	if identityFile == "" {
+		identityFile = filepath.Join(identity.DefaultDir(), "host_ed25519")
+	}
+	h.identity, err = identity.LoadOrCreate(identityFile)
+	if err != nil {
+		return
+	}
+	log.Infof("Host %s identity %s", h.Name, h.identity.Fingerprint())
+
 	h.fs, err = fs.Init(modConfig.BaseDir, modConfig.InvisibleFiles, modConfig.ReadOnly)
 	if err != nil {
 		return
 	}
+	h.fs.SetTrashPolicy(modConfig.Trash)
+	defer h.fs.Close()
 	h.Features = make(map[string]func(args ...string) *msg.Message)
+	h.Streams = make(map[string]func(send func(*msg.Message) error, cancel <-chan struct{}, args ...string) *msg.Message)
+	h.fsFeatures = make(map[string]func(fs *fs.FSConfig, args ...string) *msg.Message)
+	h.fsStreams = make(map[string]func(fs *fs.FSConfig, send func(*msg.Message) error, cancel <-chan struct{}, args ...string) *msg.Message)
 
 	err = h.initializeFileSystem()
 	if err != nil {
@@ -65,37 +166,261 @@ func Run(modConfig *ModuleConfig) (h *Host, err error) {
 	}
 
 	initializeCMD(h.Features)
+
+	if modConfig.Direct != "" {
+		h.direct, err = p2p.Listen(modConfig.Direct)
+		if err != nil {
+			return
+		}
+		defer h.direct.Close()
+	}
+
+	if modConfig.MetricsAddress != "" {
+		l, err := metrics.Serve(modConfig.MetricsAddress)
+		if err != nil {
+			return h, err
+		}
+		defer l.Close()
+	}
+
+	if modConfig.Listen != "" || modConfig.LAN {
+		address := modConfig.Listen
+		if address == "" {
+			address = ":0"
+		}
+		transport := modConfig.ListenTransport
+		if transport == nil {
+			transport = comm.TransportFor(address)
+		}
+		l, err := transport.Listen(address)
+		if err != nil {
+			return h, err
+		}
+		defer l.Close()
+		defer h.closeOnStop(func() { l.Close() })()
+		log.Infof("Host %s accepting clients on %s", h.Name, l.Addr())
+		limits := modConfig.ListenLimits
+		if limits == (tcp2.Limits{}) {
+			limits = DefaultListenLimits
+		}
+		guard := tcp2.NewGuard(limits)
+
+		if modConfig.LAN {
+			_, port, _ := net.SplitHostPort(l.Addr().String())
+			p, err := strconv.Atoi(port)
+			if err != nil {
+				return h, fmt.Errorf("Can't announce %s", l.Addr())
+			}
+			a, err := discovery.Announce(modConfig.Discovery, h.Name, p, h.identity.Fingerprint())
+			if err != nil {
+				return h, err
+			}
+			defer a.Close()
+		}
+		if h.relay == "" {
+			return h, h.accept(l, guard)
+		}
+		go h.accept(l, guard)
+	}
 	return h, h.start()
 }
 
+// accept serves clients connecting to the host itself until l is closed, within what guard allows
+func (h *Host) accept(l net.Listener, guard *tcp2.Guard) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		limited, reason := guard.Admit(conn)
+		if limited == nil {
+			log.Debugf("Turning away %s: %s", conn.RemoteAddr(), reason)
+			conn.Close()
+			continue
+		}
+		go func() {
+			c := comm.New(limited)
+			defer c.Close()
+			defer h.closeOnStop(c.Close)()
+			if err := guard.AcceptClient(c, h.Pass, h.Name); err != nil {
+				// Someone may be guessing the password
+				log.Warnf("Client from %s failed to log in: %s", limited.RemoteAddr(), err)
+				return
+			}
+			h.Lock()
+			h.CurrentConnections++
+			h.Unlock()
+			h.serve(&session{comm: c, files: h.fs.Session()})
+			h.Lock()
+			h.CurrentConnections--
+			h.Unlock()
+		}()
+	}
+}
+
 func (h *Host) start() (err error) {
-	c, err := tcp2.ConnectToTCPServer("localhost:8080", "", h.Name)
+	visibility := tcp2.VISIBILITY_UNLISTED
+	if h.public {
+		visibility = tcp2.VISIBILITY_PUBLIC
+	}
+	req := &tcp2.RoomRequest{
+		Room:         h.Name,
+		Visibility:   visibility,
+		Capabilities: h.capabilities(),
+	}
+	if h.direct != nil {
+		req.Addresses = h.direct.Addresses()
+	}
+	c, err := tcp2.RegisterHost(h.transport, h.relay, h.Pass, req)
 	if err != nil {
 		log.Error(err)
 		return
 	}
+	defer h.closeOnStop(c.Close)()
+	return h.serve(&session{comm: c, relayed: true, files: h.fs.Session()})
+}
+
+// serve answers the clients on the other end of sess until its connection fails
+func (h *Host) serve(sess *session) error {
+	c := sess.comm
+	// Nobody is left to stream to
+	defer sess.cancelStreams()
 	for {
 		data, err := c.Receive()
 		if err != nil {
 			log.Debug(err)
+			return err
 		}
 		if bytes.Equal(data, []byte{1}) {
 			continue
 		}
-		var req Request
-		if err := json.Unmarshal(data, &req); err != nil {
+		if closed := tcp2.ParseCloseNotice(data); closed != nil && sess.relayed {
+			log.Warn(closed)
+			c.Close()
+			return closed
+		}
+		if peer := tcp2.ParsePeerInfo(data); peer != nil && sess.relayed {
+			// The next client could also be reached directly
+			sess.setPeer(peer)
+			continue
+		}
+		req, err := sess.open(data)
+		comm.Recycle(data)
+		if err != nil {
+			log.Debug(err)
+			sess.send(msg.New(msg.TYPE_ERROR, err.Error()))
 			continue
 		}
-		go h.handleRequest(&client{
-			Comm: c,
-			Req:  req,
-		})
+		switch req.Type {
+		case msg.TYPE_HELLO:
+			// A new client has arrived, the old session is over
+			if err := h.handleHello(sess, req); err != nil {
+				log.Warn(err)
+			}
+		case msg.TYPE_DIRECT:
+			if err := h.handleDirect(sess, req); err != nil {
+				log.Warn(err)
+			}
+		case msg.TYPE_CANCEL:
+			sess.cancelStream(req.Body)
+		default:
+			if req.ID == "" {
+				req.ID = msg.NewID()
+			}
+			go h.handleRequest(&client{
+				Req:        req,
+				sess:       sess,
+				generation: sess.current(),
+			})
+		}
 	}
 }
 
+// directTimeout bounds how long a client and the host try to reach each other without the relay
+var directTimeout = 3 * time.Second
+
+// handleDirect agrees to try a direct connection with the client of sess and, if one is made,
+// serves the client there as well. Body is the nonce of the attempt.
+func (h *Host) handleDirect(sess *session, req Request) error {
+	key, peer := sess.direct()
+	if h.direct == nil || peer == nil || key == nil {
+		return sess.send(msg.New(msg.TYPE_ERROR, "Direct connections not available"))
+	}
+	if err := sess.send(msg.New(msg.TYPE_DIRECT, "")); err != nil {
+		return err
+	}
+	go func() {
+		conn, err := h.direct.Accept(p2p.Candidates(peer.Observed, peer.Addresses), directTimeout, key, req.Body)
+		if err != nil {
+			log.Debugf("No direct connection: %s", err)
+			return
+		}
+		log.Infof("Client connected directly from %s", conn.RemoteAddr())
+		defer conn.Close()
+		defer h.closeOnStop(func() { conn.Close() })()
+		// Still the same client, in the same directory
+		h.serve(&session{comm: comm.New(conn), key: key, files: sess.workspace()})
+	}()
+	return nil
+}
+
+// closeOnStop calls shut if the host is stopped before the returned func is called
+func (h *Host) closeOnStop(shut func()) (release func()) {
+	released := make(chan struct{})
+	go func() {
+		select {
+		case <-h.stop:
+			shut()
+		case <-released:
+		}
+	}()
+	return func() {
+		close(released)
+	}
+}
+
+// handleHello answers the handshake of a new client and switches the session to its key
+func (h *Host) handleHello(sess *session, req Request) error {
+	// Whatever the last client left running ends with it
+	sess.newClient()
+	// The new client starts afresh at baseDir
+	sess.setWorkspace(h.fs.Session())
+	var ch identity.ClientHello
+	if err := json.Unmarshal([]byte(req.Body), &ch); err != nil {
+		return sess.send(msg.New(msg.TYPE_ERROR, err.Error()))
+	}
+	sh, key, err := h.identity.Accept(h.Name, &ch)
+	if err != nil {
+		return sess.send(msg.New(msg.TYPE_ERROR, err.Error()))
+	}
+	bys, err := json.Marshal(sh)
+	if err != nil {
+		return err
+	}
+	if err = sess.send(msg.New(msg.TYPE_HELLO, string(bys))); err != nil {
+		return err
+	}
+	sess.setKey(key)
+	log.Debug("Handshake complete")
+	return nil
+}
+
+// capabilities lists the commands this host offers
+func (h *Host) capabilities() []string {
+	caps := make([]string, 0, len(h.Features)+len(h.fsFeatures))
+	for k := range h.Features {
+		caps = append(caps, k)
+	}
+	for k := range h.fsFeatures {
+		caps = append(caps, k)
+	}
+	sort.Strings(caps)
+	return caps
+}
+
 // AddFeature adds a command-func pair to the host for remote calls
 func (h *Host) AddFeature(cmd string, f func(args ...string) *msg.Message) error {
-	if _, ok := h.Features[cmd]; ok {
+	if h.hasFeature(cmd) {
 		return fmt.Errorf("CMD %s already exists", cmd)
 	}
 	h.Features[cmd] = f
@@ -103,7 +428,35 @@ func (h *Host) AddFeature(cmd string, f func(args ...string) *msg.Message) error
 	return nil
 }
 
-func (h *Host) handleCMD(cmd string) (res *msg.Message, err error) {
+// hasFeature tells whether cmd is taken by a feature or a stream
+func (h *Host) hasFeature(cmd string) bool {
+	_, feature := h.Features[cmd]
+	_, fsFeature := h.fsFeatures[cmd]
+	_, stream := h.Streams[cmd]
+	_, fsStream := h.fsStreams[cmd]
+	return feature || fsFeature || stream || fsStream
+}
+
+// isStream tells whether cmd streams its results
+func (h *Host) isStream(cmd string) bool {
+	return h.Streams[cmd] != nil || h.fsStreams[cmd] != nil
+}
+
+// handleStream runs a streaming command, sending its parts as they come
+func (h *Host) handleStream(c *client, args []string) *msg.Message {
+	cancel, err := c.sess.startStream(c.generation, c.Req.ID)
+	if err != nil {
+		return msg.New(msg.TYPE_ERROR, err.Error())
+	}
+	defer c.sess.endStream(c.Req.ID)
+	send := c.send
+	if stream, ok := h.fsStreams[args[0]]; ok {
+		return stream(c.sess.workspace(), send, cancel, args[1:]...)
+	}
+	return h.Streams[args[0]](send, cancel, args[1:]...)
+}
+
+func (h *Host) handleCMD(sess *session, cmd string) (res *msg.Message, err error) {
 	fmt.Println(cmd)
 	s := strings.Split(cmd, " ")
 	fmt.Println(s)
@@ -112,6 +465,10 @@ func (h *Host) handleCMD(cmd string) (res *msg.Message, err error) {
 			s[i] = strings.TrimSpace(s[i])
 			fmt.Println(s[i])
 		}
+		if f, ok := h.fsFeatures[s[0]]; ok {
+			res = f(sess.workspace(), s[1:]...)
+			return
+		}
 		if _, ok := h.Features[s[0]]; !ok {
 			err = fmt.Errorf("No such command")
 			return
@@ -121,22 +478,46 @@ func (h *Host) handleCMD(cmd string) (res *msg.Message, err error) {
 	return
 }
 
+// featureLabel names the feature cmd runs for metrics, without letting clients invent labels
+func (h *Host) featureLabel(cmd string) string {
+	fields := strings.Fields(cmd)
+	if len(fields) == 0 {
+		return "unknown"
+	}
+	if h.hasFeature(fields[0]) {
+		return fields[0]
+	}
+	return "unknown"
+}
+
 func (h *Host) handleRequest(c *client) error {
 	switch c.Req.Type {
 	case "text/cmd":
 		log.Debugf("Handle CMD %s", c.Req.Body)
-		res, err := h.handleCMD(c.Req.Body)
+		start := time.Now()
+		var res *msg.Message
+		var err error
+		if args := strings.Fields(c.Req.Body); len(args) > 0 && h.isStream(args[0]) {
+			res = h.handleStream(c, args)
+		} else {
+			res, err = h.handleCMD(c.sess, c.Req.Body)
+		}
 		if err != nil {
 			res = msg.New(msg.TYPE_ERROR, err.Error())
 		}
+		feature := h.featureLabel(c.Req.Body)
+		commandsTotal.Inc(feature)
+		commandSeconds.Observe(time.Since(start).Seconds(), feature)
+		if res == nil || res.Type == msg.TYPE_ERROR {
+			commandErrors.Inc(feature)
+		}
 		log.Debugf("Result: %s", res)
-		bys, err := res.ConvertToNetForm()
-		if err != nil {
+		err = c.send(res)
+		if err == errClientGone {
+			log.Debugf("Dropped the result of %s for a client that left", feature)
+		} else if err != nil {
 			log.Error(err)
-			return err
 		}
-		n, err := c.Comm.Write(bys)
-		log.Debugf("Wrote %d bytes", n)
 		return err
 	default:
 		log.Warnf("Unknown request type %s", c.Req.Type)
@@ -154,16 +535,29 @@ func initializeCMD(fs map[string]func(args ...string) *msg.Message) {
 }
 
 func (h *Host) initializeFileSystem() (err error) {
-	h.Features["ls"] = h.fs.ListFiles
-	h.Features["cd"] = h.fs.CD
-	h.Features["mkdir"] = h.fs.Mkdir
-	h.Features["rm"] = h.fs.Remove
+	h.fsFeatures["ls"] = (*fs.FSConfig).ListFiles
+	h.fsFeatures["cd"] = (*fs.FSConfig).CD
+	h.fsFeatures["mkdir"] = (*fs.FSConfig).Mkdir
+	h.fsFeatures["rm"] = (*fs.FSConfig).Remove
+	h.fsFeatures["mv"] = (*fs.FSConfig).Move
+	h.fsFeatures["cp"] = (*fs.FSConfig).Copy
+	h.fsFeatures["trash"] = (*fs.FSConfig).Trash
+	h.fsFeatures["stat"] = (*fs.FSConfig).Stat
+	h.fsFeatures["tree"] = (*fs.FSConfig).Tree
+	h.fsFeatures["du"] = (*fs.FSConfig).DiskUsage
+	h.fsFeatures["head"] = (*fs.FSConfig).Head
+	h.fsFeatures["read"] = (*fs.FSConfig).Read
+	h.fsStreams["find"] = (*fs.FSConfig).Find
+	h.fsStreams["grep"] = (*fs.FSConfig).Grep
+	// Streamed so that tail -f can follow, plain tail answers at once
+	h.fsStreams["tail"] = (*fs.FSConfig).Tail
+	h.fsStreams["watch"] = (*fs.FSConfig).Watch
 	return nil
 }
 
 func (h *Host) initializeCustomCMD(m map[string]func(args ...string) *msg.Message) error {
 	for k := range m {
-		if _, exist := h.Features[k]; exist {
+		if h.hasFeature(k) {
 			return fmt.Errorf("Duplicate function name found: %s", k)
 		}
 	}
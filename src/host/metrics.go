@@ -0,0 +1,12 @@
+package host
+
+import "github.com/miska12345/MiskaRFS/src/metrics"
+
+var (
+	commandsTotal = metrics.Default.Counter("miskarfs_host_commands_total",
+		"Commands executed by feature.", "feature")
+	commandErrors = metrics.Default.Counter("miskarfs_host_command_errors_total",
+		"Commands that returned an error by feature.", "feature")
+	commandSeconds = metrics.Default.Histogram("miskarfs_host_command_duration_seconds",
+		"Time taken to execute commands by feature.", nil, "feature")
+)
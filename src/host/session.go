@@ -0,0 +1,189 @@
+package host
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/miska12345/MiskaRFS/src/comm"
+	"github.com/miska12345/MiskaRFS/src/fs"
+	msg "github.com/miska12345/MiskaRFS/src/message"
+	"github.com/miska12345/MiskaRFS/src/tcp2"
+	"github.com/schollz/croc/v8/src/crypt"
+)
+
+// session is the state of the client on the other end of a connection
+type session struct {
+	comm *comm.Comm
+	key  []byte
+	// relayed is set when the relay is on the other end, only then are its control frames believed
+	relayed bool
+	// peer is where the relay says the client may be reached directly
+	peer *tcp2.PeerInfo
+	// files is the file system as the client sees it, from its current directory
+	files *fs.FSConfig
+	// streams are closed to cancel the streamed responses of requests by ID
+	streams map[string]chan struct{}
+	// generation counts the clients the session has had, what is meant for an earlier one is dropped
+	generation int
+	// sending keeps a new client from arriving halfway through a reply to the last one
+	sending sync.Mutex
+	sync.Mutex
+}
+
+// errClientGone is what replying to a client that has been replaced returns
+var errClientGone = fmt.Errorf("Client is gone")
+
+// open decodes a frame received from the client.
+// Everything but a hello must be encrypted with the session key.
+func (s *session) open(data []byte) (req Request, err error) {
+	if err = json.Unmarshal(data, &req); err == nil {
+		if req.Type == msg.TYPE_HELLO {
+			return
+		}
+		return req, fmt.Errorf("Handshake required")
+	}
+
+	s.Lock()
+	key := s.key
+	s.Unlock()
+	if key == nil {
+		return req, fmt.Errorf("Handshake required")
+	}
+	data, err = crypt.Decrypt(data, key)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &req)
+	return
+}
+
+// send encrypts the message with the session key, if any, and writes it to the client
+func (s *session) send(m *msg.Message) error {
+	s.sending.Lock()
+	defer s.sending.Unlock()
+	return s.write(m)
+}
+
+// reply sends m to the client of the given generation, unless another has taken its place
+func (s *session) reply(generation int, m *msg.Message) error {
+	s.sending.Lock()
+	defer s.sending.Unlock()
+	if s.current() != generation {
+		return errClientGone
+	}
+	return s.write(m)
+}
+
+func (s *session) write(m *msg.Message) (err error) {
+	bys, err := m.ConvertToNetForm()
+	if err != nil {
+		return
+	}
+	s.Lock()
+	key := s.key
+	s.Unlock()
+	if key != nil {
+		bys, err = crypt.Encrypt(bys, key)
+		if err != nil {
+			return
+		}
+	}
+	return s.comm.Send(bys)
+}
+
+// current returns the generation of the client the session is serving
+func (s *session) current() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.generation
+}
+
+// newClient forgets the last client of the session, cancelling its streams and dropping its replies
+func (s *session) newClient() {
+	s.sending.Lock()
+	s.Lock()
+	s.generation++
+	s.key = nil
+	s.Unlock()
+	s.sending.Unlock()
+	s.cancelStreams()
+}
+
+func (s *session) setKey(key []byte) {
+	s.Lock()
+	s.key = key
+	s.Unlock()
+}
+
+func (s *session) setPeer(peer *tcp2.PeerInfo) {
+	s.Lock()
+	s.peer = peer
+	s.Unlock()
+}
+
+func (s *session) setWorkspace(files *fs.FSConfig) {
+	s.Lock()
+	s.files = files
+	s.Unlock()
+}
+
+// workspace returns the file system as the client sees it
+func (s *session) workspace() *fs.FSConfig {
+	s.Lock()
+	defer s.Unlock()
+	return s.files
+}
+
+// direct returns what a direct connection with the client needs
+func (s *session) direct() ([]byte, *tcp2.PeerInfo) {
+	s.Lock()
+	defer s.Unlock()
+	return s.key, s.peer
+}
+
+// startStream returns what cancels the stream for request id of the client of the given generation.
+// It fails if another stream has the same ID.
+func (s *session) startStream(generation int, id string) (<-chan struct{}, error) {
+	cancel := make(chan struct{})
+	s.Lock()
+	defer s.Unlock()
+	if s.generation != generation {
+		// Its client is gone already
+		close(cancel)
+		return cancel, nil
+	}
+	if _, ok := s.streams[id]; ok {
+		return nil, fmt.Errorf("Request %s is already streaming", id)
+	}
+	if s.streams == nil {
+		s.streams = make(map[string]chan struct{})
+	}
+	s.streams[id] = cancel
+	return cancel, nil
+}
+
+func (s *session) cancelStream(id string) {
+	s.Lock()
+	if cancel, ok := s.streams[id]; ok {
+		close(cancel)
+		delete(s.streams, id)
+	}
+	s.Unlock()
+}
+
+// cancelStreams cancels every stream of the session
+func (s *session) cancelStreams() {
+	s.Lock()
+	for id, cancel := range s.streams {
+		close(cancel)
+		delete(s.streams, id)
+	}
+	s.Unlock()
+}
+
+func (s *session) endStream(id string) {
+	s.Lock()
+	delete(s.streams, id)
+	s.Unlock()
+}
@@ -0,0 +1,149 @@
+package identity
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/schollz/croc/v8/src/crypt"
+	"golang.org/x/crypto/curve25519"
+)
+
+// Version is the version of the handshake protocol
+const Version = 1
+
+const nonceSize = 32
+
+var transcriptLabel = []byte("MiskaRFS handshake")
+
+// ClientHello is the first message a client sends to a host
+type ClientHello struct {
+	Version   int
+	Name      string
+	Ephemeral []byte
+	Nonce     []byte
+}
+
+// ServerHello is the host's answer to a ClientHello, signed with its identity
+type ServerHello struct {
+	Name      string
+	Identity  []byte
+	Ephemeral []byte
+	Nonce     []byte
+	Signature []byte
+}
+
+// Handshake holds the client side state of a handshake in progress
+type Handshake struct {
+	hello   *ClientHello
+	private []byte
+}
+
+// NewHandshake starts a handshake with the host called name
+func NewHandshake(name string) (hs *Handshake, err error) {
+	hs = new(Handshake)
+	hs.hello = &ClientHello{
+		Version: Version,
+		Name:    name,
+	}
+	hs.private, hs.hello.Ephemeral, err = ephemeral()
+	if err != nil {
+		return nil, err
+	}
+	hs.hello.Nonce, err = nonce()
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Hello returns the message to send to the host
+func (hs *Handshake) Hello() *ClientHello {
+	return hs.hello
+}
+
+// Finish verifies the host's answer and returns the session key.
+// The caller is responsible for checking sh.Identity against its known hosts.
+func (hs *Handshake) Finish(sh *ServerHello) (key []byte, err error) {
+	if sh.Name != hs.hello.Name {
+		return nil, fmt.Errorf("Wanted host %s but reached %s", hs.hello.Name, sh.Name)
+	}
+	if len(sh.Identity) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("Invalid host identity")
+	}
+	t := transcript(hs.hello, sh)
+	if !ed25519.Verify(sh.Identity, t, sh.Signature) {
+		return nil, fmt.Errorf("Bad handshake signature from %s", sh.Name)
+	}
+	return sessionKey(hs.private, sh.Ephemeral, t)
+}
+
+// Accept answers a ClientHello on behalf of the host called name and returns the session key
+func (id *Identity) Accept(name string, ch *ClientHello) (sh *ServerHello, key []byte, err error) {
+	if ch.Version != Version {
+		return nil, nil, fmt.Errorf("Unsupported handshake version %d", ch.Version)
+	}
+	if len(ch.Nonce) != nonceSize {
+		return nil, nil, fmt.Errorf("Invalid client nonce")
+	}
+	sh = &ServerHello{
+		Name:     name,
+		Identity: id.Public,
+	}
+	private, public, err := ephemeral()
+	if err != nil {
+		return
+	}
+	sh.Ephemeral = public
+	sh.Nonce, err = nonce()
+	if err != nil {
+		return
+	}
+	t := transcript(ch, sh)
+	sh.Signature = id.Sign(t)
+	key, err = sessionKey(private, ch.Ephemeral, t)
+	return
+}
+
+// transcript serializes everything both sides said except the signature
+func transcript(ch *ClientHello, sh *ServerHello) []byte {
+	var buf bytes.Buffer
+	buf.Write(transcriptLabel)
+	binary.Write(&buf, binary.LittleEndian, uint32(ch.Version))
+	for _, field := range [][]byte{
+		[]byte(ch.Name), ch.Ephemeral, ch.Nonce,
+		[]byte(sh.Name), sh.Identity, sh.Ephemeral, sh.Nonce,
+	} {
+		binary.Write(&buf, binary.LittleEndian, uint32(len(field)))
+		buf.Write(field)
+	}
+	return buf.Bytes()
+}
+
+func sessionKey(private, peer, transcript []byte) (key []byte, err error) {
+	shared, err := curve25519.X25519(private, peer)
+	if err != nil {
+		return
+	}
+	salt := sha256.Sum256(transcript)
+	key, _, err = crypt.New(shared, salt[:])
+	return
+}
+
+func ephemeral() (private, public []byte, err error) {
+	private = make([]byte, curve25519.ScalarSize)
+	if _, err = rand.Read(private); err != nil {
+		return
+	}
+	public, err = curve25519.X25519(private, curve25519.Basepoint)
+	return
+}
+
+func nonce() ([]byte, error) {
+	b := make([]byte, nonceSize)
+	_, err := rand.Read(b)
+	return b, err
+}
@@ -0,0 +1,100 @@
+// Package identity manages the long-lived host keys and the host-client handshake
+package identity
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+const pemType = "PRIVATE KEY"
+
+// Identity is the Ed25519 key pair a host uses to prove who it is
+type Identity struct {
+	private ed25519.PrivateKey
+	Public  ed25519.PublicKey
+}
+
+// DefaultDir returns the directory that holds keys and known_hosts by default
+func DefaultDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".miskarfs"
+	}
+	return filepath.Join(home, ".miskarfs")
+}
+
+// Generate creates a new random identity
+func Generate() (*Identity, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{private: priv, Public: pub}, nil
+}
+
+// LoadOrCreate reads the identity stored at path, generating and saving a new one if it does not exist
+func LoadOrCreate(path string) (id *Identity, err error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		id, err = Generate()
+		if err != nil {
+			return
+		}
+		err = id.save(path)
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != pemType {
+		return nil, fmt.Errorf("%s is not a PEM encoded private key", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error parsing "+path)
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an Ed25519 key", path)
+	}
+	return &Identity{private: priv, Public: priv.Public().(ed25519.PublicKey)}, nil
+}
+
+func (id *Identity) save(path string) error {
+	der, err := x509.MarshalPKCS8PrivateKey(id.private)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: pemType, Bytes: der}), 0600)
+}
+
+// Sign signs b with the private key
+func (id *Identity) Sign(b []byte) []byte {
+	return ed25519.Sign(id.private, b)
+}
+
+// Fingerprint returns the SHA256 fingerprint of the public key
+func (id *Identity) Fingerprint() string {
+	return Fingerprint(id.Public)
+}
+
+// Fingerprint returns the SHA256 fingerprint of a public key in the form SHA256:<base64>
+func Fingerprint(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,92 @@
+package identity_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miska12345/MiskaRFS/src/identity"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadOrCreate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "identity")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "keys", "host_ed25519")
+	id1, err := identity.LoadOrCreate(path)
+	assert.Nil(t, err)
+	id2, err := identity.LoadOrCreate(path)
+	assert.Nil(t, err)
+	assert.Equal(t, id1.Public, id2.Public)
+
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestHandshake(t *testing.T) {
+	id, err := identity.Generate()
+	assert.Nil(t, err)
+
+	hs, err := identity.NewHandshake("pc-admin")
+	assert.Nil(t, err)
+	sh, hostKey, err := id.Accept("pc-admin", hs.Hello())
+	assert.Nil(t, err)
+	clientKey, err := hs.Finish(sh)
+	assert.Nil(t, err)
+	assert.Equal(t, hostKey, clientKey)
+
+	// Someone else answering for the host
+	impostor, err := identity.Generate()
+	assert.Nil(t, err)
+	hs, err = identity.NewHandshake("pc-admin")
+	assert.Nil(t, err)
+	sh, _, err = impostor.Accept("pc-admin", hs.Hello())
+	assert.Nil(t, err)
+	sh.Identity = id.Public
+	_, err = hs.Finish(sh)
+	assert.NotNil(t, err)
+
+	// Host answering under another name
+	hs, err = identity.NewHandshake("pc-admin")
+	assert.Nil(t, err)
+	sh, _, err = id.Accept("pc-other", hs.Hello())
+	assert.Nil(t, err)
+	_, err = hs.Finish(sh)
+	assert.NotNil(t, err)
+}
+
+func TestKnownHosts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "identity")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "known_hosts")
+
+	id, err := identity.Generate()
+	assert.Nil(t, err)
+	other, err := identity.Generate()
+	assert.Nil(t, err)
+
+	kh, err := identity.LoadKnownHosts(path)
+	assert.Nil(t, err)
+	// Trust on first use
+	assert.Nil(t, kh.Check("pc-admin", id.Public))
+	assert.Nil(t, kh.Check("pc-admin", id.Public))
+
+	// Pinned keys survive a reload
+	kh, err = identity.LoadKnownHosts(path)
+	assert.Nil(t, err)
+	assert.Nil(t, kh.Check("pc-admin", id.Public))
+	err = kh.Check("pc-admin", other.Public)
+	mismatch, ok := err.(*identity.KeyMismatchError)
+	assert.True(t, ok)
+	assert.Equal(t, 1, mismatch.Line)
+	assert.Equal(t, id.Fingerprint(), mismatch.Want)
+	assert.Equal(t, other.Fingerprint(), mismatch.Got)
+
+	assert.Nil(t, kh.Check("pc-other", other.Public))
+}
@@ -0,0 +1,126 @@
+package identity
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/miska12345/MiskaRFS/src/logger"
+)
+
+const keyType = "ed25519"
+
+// KnownHosts is a known_hosts style file that pins host names to identity keys
+type KnownHosts struct {
+	path  string
+	keys  map[string]knownKey
+	lines int
+	sync.Mutex
+}
+
+type knownKey struct {
+	key  ed25519.PublicKey
+	line int
+}
+
+// KeyMismatchError is returned when a host presents a key different from the pinned one
+type KeyMismatchError struct {
+	Name string
+	File string
+	Line int
+	Want string
+	Got  string
+}
+
+func (e *KeyMismatchError) Error() string {
+	var buf strings.Builder
+	buf.WriteString("\n@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@\n")
+	buf.WriteString("@    WARNING: REMOTE HOST IDENTIFICATION HAS CHANGED!     @\n")
+	buf.WriteString("@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@\n")
+	buf.WriteString(fmt.Sprintf("Someone could be impersonating host %s.\n", e.Name))
+	buf.WriteString(fmt.Sprintf("Expected key %s\n", e.Want))
+	buf.WriteString(fmt.Sprintf("Received key %s\n", e.Got))
+	buf.WriteString(fmt.Sprintf("Offending entry in %s:%d\n", e.File, e.Line))
+	return buf.String()
+}
+
+// LoadKnownHosts reads the known hosts at path, a missing file is treated as empty
+func LoadKnownHosts(path string) (kh *KnownHosts, err error) {
+	kh = &KnownHosts{
+		path: path,
+		keys: make(map[string]knownKey),
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return kh, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		kh.lines++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[1] != keyType {
+			return nil, fmt.Errorf("%s:%d: malformed entry", path, kh.lines)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[2])
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%s:%d: malformed key", path, kh.lines)
+		}
+		kh.keys[fields[0]] = knownKey{key: key, line: kh.lines}
+	}
+	return kh, scanner.Err()
+}
+
+// Check verifies key against the pinned key for name.
+// Keys of unknown hosts are trusted on first use and appended to the file.
+func (kh *KnownHosts) Check(name string, key ed25519.PublicKey) error {
+	kh.Lock()
+	defer kh.Unlock()
+	if known, ok := kh.keys[name]; ok {
+		if !bytes.Equal(known.key, key) {
+			err := &KeyMismatchError{
+				Name: name,
+				File: kh.path,
+				Line: known.line,
+				Want: Fingerprint(known.key),
+				Got:  Fingerprint(key),
+			}
+			log.Error(err)
+			return err
+		}
+		return nil
+	}
+
+	if strings.ContainsAny(name, " \t\n") {
+		return fmt.Errorf("Invalid host name %q", name)
+	}
+	if err := os.MkdirAll(filepath.Dir(kh.path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(kh.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = fmt.Fprintf(f, "%s %s %s\n", name, keyType, base64.StdEncoding.EncodeToString(key)); err != nil {
+		return err
+	}
+	kh.lines++
+	kh.keys[name] = knownKey{key: key, line: kh.lines}
+	log.Warnf("Permanently added %s (%s) to the list of known hosts", name, Fingerprint(key))
+	return nil
+}
@@ -74,6 +74,10 @@ func SetLevel(s string) {
 	if strings.TrimSpace(strings.ToLower(os.Getenv("LOGGER"))) != "" {
 		return
 	}
+	// Servers started side by side in one process each set the level, only a change needs writing
+	if s == l.GetLevel() {
+		return
+	}
 	l.SetLevel(s)
 }
 
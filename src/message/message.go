@@ -1,14 +1,37 @@
 // package message implements a generic-network-response interface
 package message
 
-import "encoding/json"
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+)
 
 const TYPE_RESPONSE = "text/res"
 const TYPE_ERROR = "text/error"
+const TYPE_HELLO = "text/hello"
+const TYPE_DIRECT = "text/direct"
+
+// TYPE_STREAM is one part of a streamed response, the last part is a TYPE_RESPONSE or TYPE_ERROR
+const TYPE_STREAM = "text/stream"
+
+// TYPE_CANCEL asks the host to stop streaming the response to the request with the ID in the body
+const TYPE_CANCEL = "text/cancel"
 
 type Message struct {
 	Type string
 	Msg  string
+	// ID is that of the request the message answers
+	ID string `json:",omitempty"`
+}
+
+// NewID returns a random ID for a request
+func NewID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
 }
 
 func New(msgType, msg string) *Message {
@@ -0,0 +1,354 @@
+// Package metrics keeps counters, gauges and histograms and exposes them in Prometheus text format
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/miska12345/MiskaRFS/src/logger"
+)
+
+// Default is the registry relay and host report to
+var Default = NewRegistry()
+
+// DefaultBuckets suit latencies in seconds
+var DefaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metric interface {
+	write(w io.Writer) error
+	kind() string
+}
+
+// Registry holds metrics by name
+type Registry struct {
+	metrics map[string]metric
+	order   []string
+	sync.Mutex
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+// register returns the metric already registered under name, if any, so packages
+// can declare their metrics at init no matter how many relays or hosts run in the process
+func (r *Registry) register(name string, m metric) metric {
+	r.Lock()
+	defer r.Unlock()
+	if old, ok := r.metrics[name]; ok {
+		if old.kind() != m.kind() {
+			panic(fmt.Sprintf("metric %s registered as %s and %s", name, old.kind(), m.kind()))
+		}
+		return old
+	}
+	r.metrics[name] = m
+	r.order = append(r.order, name)
+	return m
+}
+
+// series is the state shared by all metric types: a value per combination of label values
+type series struct {
+	name   string
+	help   string
+	labels []string
+	values map[string]*value
+	sync.Mutex
+}
+
+type value struct {
+	labels  []string
+	v       float64
+	buckets []uint64
+	count   uint64
+}
+
+func newSeries(name, help string, labels []string) series {
+	return series{name: name, help: help, labels: labels, values: make(map[string]*value)}
+}
+
+// get returns the value for labelValues, the caller must hold the lock
+func (s *series) get(labelValues []string) *value {
+	if len(labelValues) != len(s.labels) {
+		panic(fmt.Sprintf("metric %s wants %d label values, got %d", s.name, len(s.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	v, ok := s.values[key]
+	if !ok {
+		v = &value{labels: append([]string{}, labelValues...)}
+		s.values[key] = v
+	}
+	return v
+}
+
+// sorted returns the values in a stable order, the caller must hold the lock
+func (s *series) sorted() []*value {
+	keys := make([]string, 0, len(s.values))
+	for k := range s.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	values := make([]*value, len(keys))
+	for i, k := range keys {
+		values[i] = s.values[k]
+	}
+	return values
+}
+
+func (s *series) header(w io.Writer, kind string) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", s.name, escapeHelp(s.help), s.name, kind)
+	return err
+}
+
+// Counter only goes up
+type Counter struct {
+	series
+}
+
+// Counter registers a counter
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	return r.register(name, &Counter{newSeries(name, help, labels)}).(*Counter)
+}
+
+// Inc adds one
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v, which must not be negative
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic("counter " + c.name + " cannot decrease")
+	}
+	c.Lock()
+	c.get(labelValues).v += v
+	c.Unlock()
+}
+
+// Value returns the current value, mostly for tests
+func (c *Counter) Value(labelValues ...string) float64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.get(labelValues).v
+}
+
+func (c *Counter) kind() string {
+	return "counter"
+}
+
+func (c *Counter) write(w io.Writer) error {
+	c.Lock()
+	defer c.Unlock()
+	if err := c.header(w, "counter"); err != nil {
+		return err
+	}
+	for _, v := range c.sorted() {
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", c.name, labelString(c.labels, v.labels), formatFloat(v.v)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Gauge goes up and down
+type Gauge struct {
+	series
+}
+
+// Gauge registers a gauge
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	return r.register(name, &Gauge{newSeries(name, help, labels)}).(*Gauge)
+}
+
+// Set replaces the value
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.Lock()
+	g.get(labelValues).v = v
+	g.Unlock()
+}
+
+// Add adds v, which may be negative
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.Lock()
+	g.get(labelValues).v += v
+	g.Unlock()
+}
+
+// Value returns the current value, mostly for tests
+func (g *Gauge) Value(labelValues ...string) float64 {
+	g.Lock()
+	defer g.Unlock()
+	return g.get(labelValues).v
+}
+
+func (g *Gauge) kind() string {
+	return "gauge"
+}
+
+func (g *Gauge) write(w io.Writer) error {
+	g.Lock()
+	defer g.Unlock()
+	if err := g.header(w, "gauge"); err != nil {
+		return err
+	}
+	for _, v := range g.sorted() {
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", g.name, labelString(g.labels, v.labels), formatFloat(v.v)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Histogram counts observations into buckets
+type Histogram struct {
+	series
+	buckets []float64
+}
+
+// Histogram registers a histogram with the given upper bounds, DefaultBuckets if nil
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64{}, buckets...)
+	sort.Float64s(buckets)
+	return r.register(name, &Histogram{series: newSeries(name, help, labels), buckets: buckets}).(*Histogram)
+}
+
+// Observe records v
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.Lock()
+	defer h.Unlock()
+	val := h.get(labelValues)
+	if val.buckets == nil {
+		val.buckets = make([]uint64, len(h.buckets))
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			val.buckets[i]++
+		}
+	}
+	val.v += v
+	val.count++
+}
+
+// Count returns the number of observations, mostly for tests
+func (h *Histogram) Count(labelValues ...string) uint64 {
+	h.Lock()
+	defer h.Unlock()
+	return h.get(labelValues).count
+}
+
+func (h *Histogram) kind() string {
+	return "histogram"
+}
+
+func (h *Histogram) write(w io.Writer) error {
+	h.Lock()
+	defer h.Unlock()
+	if err := h.header(w, "histogram"); err != nil {
+		return err
+	}
+	labels := append(append([]string{}, h.labels...), "le")
+	for _, v := range h.sorted() {
+		for i, b := range h.buckets {
+			var n uint64
+			if v.buckets != nil {
+				n = v.buckets[i]
+			}
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(labels, withLabel(v.labels, formatFloat(b))), n); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(labels, withLabel(v.labels, "+Inf")), v.count); err != nil {
+			return err
+		}
+		ls := labelString(h.labels, v.labels)
+		if _, err := fmt.Fprintf(w, "%s_sum%s %s\n%s_count%s %d\n", h.name, ls, formatFloat(v.v), h.name, ls, v.count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteText renders every metric in Prometheus text format
+func (r *Registry) WriteText(w io.Writer) error {
+	r.Lock()
+	metrics := make([]metric, len(r.order))
+	for i, name := range r.order {
+		metrics[i] = r.metrics[name]
+	}
+	r.Unlock()
+	for _, m := range metrics {
+		if err := m.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ServeHTTP serves the metrics for scraping
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := r.WriteText(w); err != nil {
+		log.Debug(err)
+	}
+}
+
+// Serve exposes the default registry at /metrics on address in the background
+func Serve(address string) (net.Listener, error) {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Default)
+	log.Infof("serving metrics on %s/metrics", l.Addr())
+	go http.Serve(l, mux)
+	return l, nil
+}
+
+func withLabel(values []string, v string) []string {
+	return append(append([]string{}, values...), v)
+}
+
+func labelString(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var buf strings.Builder
+	buf.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(name)
+		buf.WriteString(`="`)
+		buf.WriteString(escapeLabel(values[i]))
+		buf.WriteByte('"')
+	}
+	buf.WriteByte('}')
+	return buf.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,62 @@
+package metrics_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miska12345/MiskaRFS/src/metrics"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteText(t *testing.T) {
+	r := metrics.NewRegistry()
+	c := r.Counter("requests_total", "Requests by code.", "code")
+	g := r.Gauge("rooms", "Open rooms.")
+	h := r.Histogram("latency_seconds", "Latency.", []float64{1, 0.1}, "op")
+
+	c.Inc("200")
+	c.Add(2, "500")
+	c.Inc("say \"hi\"\n")
+	g.Add(3)
+	g.Add(-1)
+	h.Observe(0.05, "ls")
+	h.Observe(0.5, "ls")
+	h.Observe(5, "ls")
+
+	// Registering again hands back the same metric
+	assert.Equal(t, c, r.Counter("requests_total", "Requests by code.", "code"))
+	assert.Panics(t, func() { r.Gauge("requests_total", "") })
+
+	var buf bytes.Buffer
+	assert.Nil(t, r.WriteText(&buf))
+	assert.Equal(t, `# HELP requests_total Requests by code.
+# TYPE requests_total counter
+requests_total{code="200"} 1
+requests_total{code="500"} 2
+requests_total{code="say \"hi\"\n"} 1
+# HELP rooms Open rooms.
+# TYPE rooms gauge
+rooms 2
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{op="ls",le="0.1"} 1
+latency_seconds_bucket{op="ls",le="1"} 2
+latency_seconds_bucket{op="ls",le="+Inf"} 3
+latency_seconds_sum{op="ls"} 5.55
+latency_seconds_count{op="ls"} 3
+`, buf.String())
+}
+
+func TestServeHTTP(t *testing.T) {
+	r := metrics.NewRegistry()
+	r.Counter("up_total", "Up.").Inc()
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := ioutil.ReadAll(rec.Body)
+	assert.Nil(t, err)
+	assert.Contains(t, string(body), "up_total 1\n")
+	assert.Contains(t, rec.Header().Get("Content-Type"), "version=0.0.4")
+}
@@ -0,0 +1,260 @@
+// Package p2p connects two peers directly, trying every address the other one might be reached at
+package p2p
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/miska12345/MiskaRFS/src/comm"
+	log "github.com/miska12345/MiskaRFS/src/logger"
+	"github.com/schollz/croc/v8/src/crypt"
+)
+
+// How long a redial waits after the other side refused, it may not be listening yet
+const redialInterval = 100 * time.Millisecond
+
+// Peer accepts direct connections and, where the OS allows, dials out from the same port
+// so that two peers dialing each other at once meet in a simultaneous open.
+type Peer struct {
+	listener net.Listener
+	port     int
+	incoming chan net.Conn
+}
+
+// Listen opens a peer on address, e.g. ":0" for any free port
+func Listen(address string) (*Peer, error) {
+	lc := net.ListenConfig{Control: reusePort}
+	l, err := lc.Listen(context.Background(), "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	p := &Peer{
+		listener: l,
+		port:     l.Addr().(*net.TCPAddr).Port,
+		incoming: make(chan net.Conn, 16),
+	}
+	go p.accept()
+	return p, nil
+}
+
+func (p *Peer) accept() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		select {
+		case p.incoming <- conn:
+		default:
+			// Nobody is connecting, or far too many at once
+			conn.Close()
+		}
+	}
+}
+
+// Close stops listening, connections already made stay open
+func (p *Peer) Close() error {
+	return p.listener.Close()
+}
+
+// Addresses lists where this peer can be reached from the local network, loopback included
+func (p *Peer) Addresses() []string {
+	port := strconv.Itoa(p.port)
+	host, _, _ := net.SplitHostPort(p.listener.Addr().String())
+	if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+		return []string{net.JoinHostPort(host, port)}
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Debug(err)
+		return []string{net.JoinHostPort("127.0.0.1", port)}
+	}
+	var list []string
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLinkLocalUnicast() || ipnet.IP.IsMulticast() {
+			continue
+		}
+		list = append(list, net.JoinHostPort(ipnet.IP.String(), port))
+	}
+	return list
+}
+
+// Candidates are the addresses to try for a peer: the ones it gave, and the address a relay
+// saw it at with each of those ports, in case a NAT forwards them
+func Candidates(observed string, addresses []string) []string {
+	seen := make(map[string]bool)
+	var list []string
+	add := func(address string) {
+		if !seen[address] {
+			seen[address] = true
+			list = append(list, address)
+		}
+	}
+	for _, address := range addresses {
+		add(address)
+	}
+	if host, _, err := net.SplitHostPort(observed); err == nil && net.ParseIP(host) != nil {
+		for _, address := range addresses {
+			if _, port, err := net.SplitHostPort(address); err == nil {
+				add(net.JoinHostPort(host, port))
+			}
+		}
+	}
+	return list
+}
+
+// NewNonce returns a random token tying both ends of one connection attempt together
+func NewNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Dial connects to the other peer, which must be running Accept with the same key and nonce.
+// The dialing side picks which connection both of them keep.
+func (p *Peer) Dial(candidates []string, timeout time.Duration, key []byte, nonce string) (net.Conn, error) {
+	var lock sync.Mutex
+	chosen := false
+	return p.connect(candidates, timeout, func(conn net.Conn) error {
+		// One nomination at a time, and only one that succeeds
+		lock.Lock()
+		defer lock.Unlock()
+		if chosen {
+			return fmt.Errorf("Already connected")
+		}
+		if err := nominate(conn, key, nonce); err != nil {
+			return err
+		}
+		chosen = true
+		return nil
+	})
+}
+
+// Accept waits for the other peer's Dial, dialing it as well in case only this side is reachable
+func (p *Peer) Accept(candidates []string, timeout time.Duration, key []byte, nonce string) (net.Conn, error) {
+	return p.connect(candidates, timeout, func(conn net.Conn) error {
+		return awaitNomination(conn, key, nonce)
+	})
+}
+
+// connect races dials to every candidate against connections coming in from the other peer.
+// Each connection is handed to verify, the first one it accepts is returned and the rest are closed.
+func (p *Peer) connect(candidates []string, timeout time.Duration, verify func(net.Conn) error) (net.Conn, error) {
+	deadline := time.Now().Add(timeout)
+	verified := make(chan net.Conn)
+	done := make(chan struct{})
+	defer close(done)
+
+	try := func(conn net.Conn) {
+		conn.SetDeadline(deadline)
+		if err := verify(conn); err != nil {
+			log.Debugf("Direct connection with %s failed: %s", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		conn.SetDeadline(time.Time{})
+		select {
+		case verified <- conn:
+		case <-done:
+			conn.Close()
+		}
+	}
+
+	dialer := net.Dialer{Deadline: deadline, Control: reusePort}
+	if simultaneousOpen {
+		dialer.LocalAddr = &net.TCPAddr{Port: p.port}
+	}
+	for _, candidate := range candidates {
+		go func(address string) {
+			for {
+				conn, err := dialer.Dial("tcp", address)
+				if err == nil {
+					try(conn)
+					return
+				}
+				log.Debugf("Dialing %s: %s", address, err)
+				select {
+				case <-done:
+					return
+				case <-time.After(redialInterval):
+				}
+				if time.Now().After(deadline) {
+					return
+				}
+			}
+		}(candidate)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case conn := <-p.incoming:
+			go try(conn)
+		case conn := <-verified:
+			log.Debugf("Direct connection with %s", conn.RemoteAddr())
+			return conn, nil
+		case <-timer.C:
+			return nil, fmt.Errorf("No direct connection within %s", timeout)
+		}
+	}
+}
+
+const (
+	nominatePrefix = "miskarfs-direct-nominate:"
+	acceptPrefix   = "miskarfs-direct-accept:"
+)
+
+// nominate tells the other peer conn is the one to use and waits for it to agree.
+// Both prove they hold the session key, and the nonce ties conn to this attempt.
+func nominate(conn net.Conn, key []byte, nonce string) error {
+	c := comm.New(conn)
+	bys, err := crypt.Encrypt([]byte(nominatePrefix+nonce), key)
+	if err != nil {
+		return err
+	}
+	if err = c.Send(bys); err != nil {
+		return err
+	}
+	bys, err = c.Receive()
+	if err != nil {
+		return err
+	}
+	bys, err = crypt.Decrypt(bys, key)
+	if err != nil {
+		return err
+	}
+	if string(bys) != acceptPrefix+nonce {
+		return fmt.Errorf("Peer did not accept the connection")
+	}
+	return nil
+}
+
+func awaitNomination(conn net.Conn, key []byte, nonce string) error {
+	c := comm.New(conn)
+	bys, err := c.Receive()
+	if err != nil {
+		return err
+	}
+	bys, err = crypt.Decrypt(bys, key)
+	if err != nil {
+		return err
+	}
+	if string(bys) != nominatePrefix+nonce {
+		return fmt.Errorf("Unexpected nomination")
+	}
+	bys, err = crypt.Encrypt([]byte(acceptPrefix+nonce), key)
+	if err != nil {
+		return err
+	}
+	return c.Send(bys)
+}
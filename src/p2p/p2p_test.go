@@ -0,0 +1,54 @@
+package p2p_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miska12345/MiskaRFS/src/comm"
+	"github.com/miska12345/MiskaRFS/src/p2p"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnect(t *testing.T) {
+	a, err := p2p.Listen("127.0.0.1:0")
+	assert.Nil(t, err)
+	defer a.Close()
+	b, err := p2p.Listen("127.0.0.1:0")
+	assert.Nil(t, err)
+	defer b.Close()
+	key := []byte("0123456789abcdef0123456789abcdef")
+	nonce, err := p2p.NewNonce()
+	assert.Nil(t, err)
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := b.Accept(p2p.Candidates("", a.Addresses()), time.Second, key, nonce)
+		assert.Nil(t, err)
+		accepted <- conn
+	}()
+	conn, err := a.Dial(p2p.Candidates("", b.Addresses()), time.Second, key, nonce)
+	assert.Nil(t, err)
+	other := <-accepted
+	assert.NotNil(t, other)
+
+	// Both ends kept the same connection
+	assert.Nil(t, comm.New(conn).Send([]byte("hello")))
+	data, err := comm.New(other).Receive()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), data)
+	conn.Close()
+	other.Close()
+
+	// A peer without the key is never nominated
+	go b.Accept(p2p.Candidates("", a.Addresses()), 500*time.Millisecond, []byte("fedcba9876543210fedcba9876543210"), nonce)
+	_, err = a.Dial(p2p.Candidates("", b.Addresses()), 500*time.Millisecond, key, nonce)
+	assert.NotNil(t, err)
+}
+
+func TestCandidates(t *testing.T) {
+	assert.Equal(t, []string{"10.0.0.2:4000", "203.0.113.7:4000"},
+		p2p.Candidates("203.0.113.7:51000", []string{"10.0.0.2:4000"}))
+	assert.Equal(t, []string{"10.0.0.2:4000"}, p2p.Candidates("", []string{"10.0.0.2:4000", "10.0.0.2:4000"}))
+}
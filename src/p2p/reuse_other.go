@@ -0,0 +1,13 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package p2p
+
+import "syscall"
+
+// reusePort does nothing here, dials go out from their own port and only the listener is reachable
+func reusePort(network, address string, c syscall.RawConn) error {
+	return nil
+}
+
+const simultaneousOpen = false
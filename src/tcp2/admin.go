@@ -0,0 +1,186 @@
+package tcp2
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/miska12345/MiskaRFS/src/logger"
+)
+
+// AdminRoom is a room as seen by the relay operator
+type AdminRoom struct {
+	Name          string
+	State         string
+	Visibility    string
+	Opened        time.Time
+	Uptime        time.Duration
+	Host          string
+	Client        string
+	BytesToClient uint64
+	BytesToHost   uint64
+	Capabilities  []string
+}
+
+// serveAdmin runs the admin API on l until it is closed
+func (s *server) serveAdmin(l net.Listener, token string) error {
+	log.Infof("starting admin server on %s", l.Addr())
+	return http.Serve(l, s.adminHandler(token))
+}
+
+func (s *server) adminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(adminPage))
+	})
+	mux.HandleFunc("/api/rooms", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.adminRooms())
+	})
+	mux.HandleFunc("/api/kick", s.adminAction(func(room string) bool {
+		return s.kickClient(room, REASON_KICKED)
+	}))
+	mux.HandleFunc("/api/close", s.adminAction(func(room string) bool {
+		return s.deleteRoom(room, REASON_CLOSED)
+	}))
+
+	// The page itself is harmless, everything under /api/ needs the token
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/") && !adminAuthorized(r, token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func adminAuthorized(r *http.Request, token string) bool {
+	got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// adminAction wraps an action on the room named in the query
+func (s *server) adminAction(action func(room string) bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		room := r.URL.Query().Get("room")
+		if !action(room) {
+			http.Error(w, "no such room", http.StatusNotFound)
+			return
+		}
+		log.Infof("admin %s on room %s from %s", r.URL.Path, room, r.RemoteAddr)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *server) adminRooms() []AdminRoom {
+	list := []AdminRoom{}
+	s.rooms.Lock()
+	for name, info := range s.rooms.rooms {
+		room := AdminRoom{
+			Name:         name,
+			State:        info.state,
+			Visibility:   info.visibility,
+			Opened:       info.opened,
+			Uptime:       time.Since(info.opened).Truncate(time.Second),
+			Capabilities: info.capabilities,
+		}
+		if info.host != nil {
+			room.Host = info.host.Connection().RemoteAddr().String()
+		}
+		if info.client != nil {
+			room.Client = info.client.Connection().RemoteAddr().String()
+		}
+		if info.stats != nil {
+			room.BytesToClient = atomic.LoadUint64(&info.stats.toClient)
+			room.BytesToHost = atomic.LoadUint64(&info.stats.toHost)
+		}
+		list = append(list, room)
+	}
+	s.rooms.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+const adminPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>MiskaRFS relay</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+</style>
+</head>
+<body>
+<h1>MiskaRFS relay</h1>
+<p>Token <input id="token" type="password"> <button onclick="refresh()">Load</button></p>
+<table>
+<thead><tr><th>Room</th><th>State</th><th>Visibility</th><th>Uptime</th><th>Host</th><th>Client</th><th>To client</th><th>To host</th><th></th></tr></thead>
+<tbody id="rooms"></tbody>
+</table>
+<script>
+function api(method, path) {
+	return fetch(path, {method: method, headers: {"Authorization": "Bearer " + document.getElementById("token").value}});
+}
+function cell(tr, text) {
+	var td = document.createElement("td");
+	td.textContent = text;
+	tr.appendChild(td);
+	return td;
+}
+function button(td, label, path) {
+	var b = document.createElement("button");
+	b.textContent = label;
+	b.onclick = function() { api("POST", path).then(refresh); };
+	td.appendChild(b);
+}
+function refresh() {
+	api("GET", "/api/rooms").then(function(res) {
+		if (!res.ok) { throw new Error(res.statusText); }
+		return res.json();
+	}).then(function(rooms) {
+		var body = document.getElementById("rooms");
+		body.innerHTML = "";
+		rooms.forEach(function(r) {
+			var tr = document.createElement("tr");
+			cell(tr, r.Name);
+			cell(tr, r.State);
+			cell(tr, r.Visibility);
+			cell(tr, Math.round(r.Uptime / 1e9) + "s");
+			cell(tr, r.Host);
+			cell(tr, r.Client);
+			cell(tr, r.BytesToClient);
+			cell(tr, r.BytesToHost);
+			var actions = cell(tr, "");
+			var q = "?room=" + encodeURIComponent(r.Name);
+			if (r.Client) { button(actions, "Kick client", "/api/kick" + q); }
+			button(actions, "Close room", "/api/close" + q);
+			body.appendChild(tr);
+		});
+	}).catch(function(e) { alert(e); });
+}
+</script>
+</body>
+</html>
+`
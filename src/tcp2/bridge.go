@@ -0,0 +1,275 @@
+package tcp2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/miska12345/MiskaRFS/src/comm"
+	log "github.com/miska12345/MiskaRFS/src/logger"
+	"github.com/miska12345/MiskaRFS/src/models"
+	"github.com/pkg/errors"
+)
+
+// The bridge forwards whole frames so that whoever leaves, the host is left at a frame boundary
+// and the next client of the room starts with a fresh frame.
+//
+// Host frames can be large file chunks, they are streamed through a pooled buffer as they arrive.
+// Client frames are requests, they are read whole before going to the host in a single write,
+// so a client dropping halfway never leaves the host with half a frame. Being read whole they are
+// kept to maxClientFrame, a client sending more is let go.
+
+// maxClientFrame bounds the frames a client sends, far more than any request needs
+const maxClientFrame = 1 << 20
+
+// bridgeConns forwards frames between host and client until one of them leaves or stop is closed,
+// calling draining once it is winding down. It returns an error if the host is gone, nil otherwise.
+func bridgeConns(host, client net.Conn, stats *roomStats, stop <-chan struct{}, draining func()) error {
+	// Deadlines left over from the handshake don't apply to the bridge
+	host.SetReadDeadline(time.Time{})
+	client.SetReadDeadline(time.Time{})
+
+	fromHost := make(chan error, 1)
+	fromClient := make(chan error, 1)
+	go func() {
+		fromHost <- forwardHost(client, host, stats)
+	}()
+	go func() {
+		fromClient <- forwardClient(host, client, stats)
+	}()
+
+	var hostErr error
+	select {
+	case hostErr = <-fromClient:
+		// The client stopped sending, let the host finish the frame it is on and stop
+		draining()
+		host.SetReadDeadline(time.Now())
+		if err := <-fromHost; hostErr == nil {
+			hostErr = err
+		}
+	case hostErr = <-fromHost:
+		if hostErr != nil {
+			// Let the client read everything the host managed to send before hanging up
+			if cw, ok := client.(closeWriter); ok {
+				cw.CloseWrite()
+			}
+		} else {
+			draining()
+		}
+		// Whatever the client is in the middle of sending is dropped
+		client.SetReadDeadline(time.Now())
+		if err := <-fromClient; hostErr == nil {
+			hostErr = err
+		}
+	case <-stop:
+		// Both sides stop at a frame boundary so the relay can have the last word
+		draining()
+		client.SetReadDeadline(time.Now())
+		host.SetReadDeadline(time.Now())
+		hostErr = <-fromClient
+		if err := <-fromHost; hostErr == nil {
+			hostErr = err
+		}
+	}
+	host.SetReadDeadline(time.Time{})
+	return hostErr
+}
+
+// closeWriter is implemented by TCP and TLS connections
+type closeWriter interface {
+	CloseWrite() error
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// forwardHost streams frames from host to client.
+// A read deadline on host asks it to stop, which it does at the next frame boundary.
+// If the client can't be written to, the rest of the frame is drained from host before returning.
+// It returns an error only if the host is gone.
+func forwardHost(client, host net.Conn, stats *roomStats) error {
+	buf := comm.Buffer(models.TCP_BUFFER_SIZE)
+	defer comm.Recycle(buf)
+	var clientErr error
+	for {
+		if clientErr != nil {
+			log.Debugf("Client is gone: %s", clientErr)
+			return nil
+		}
+
+		got := 0
+		for got < comm.HeaderSize {
+			n, err := host.Read(buf[got:comm.HeaderSize])
+			got += n
+			if err == nil {
+				continue
+			}
+			if !isTimeout(err) {
+				return errors.Wrap(err, "Host is gone")
+			}
+			if got == 0 {
+				// Told to stop between frames
+				return nil
+			}
+			host.SetReadDeadline(time.Time{})
+		}
+
+		remaining := int(binary.LittleEndian.Uint32(buf))
+		filled := comm.HeaderSize
+		for {
+			if remaining > 0 {
+				n := len(buf) - filled
+				if n > remaining {
+					n = remaining
+				}
+				m, err := host.Read(buf[filled : filled+n])
+				filled += m
+				remaining -= m
+				if err != nil {
+					if !isTimeout(err) {
+						return errors.Wrap(err, "Host is gone")
+					}
+					// Too late to stop, this frame goes out whole
+					host.SetReadDeadline(time.Time{})
+				}
+			}
+			if filled > 0 && clientErr == nil {
+				clientErr = send(client, buf[:filled], stats.toClientLimit, &stats.toClient, "to_client", stats)
+			}
+			filled = 0
+			if remaining == 0 {
+				break
+			}
+		}
+	}
+}
+
+// drainHost reads and drops frames from host while its room waits for a client, so that what it meant
+// for the client that left never reaches the next one.
+// A read deadline on host asks it to stop, which it does at the next frame boundary.
+// It returns an error only if the host is gone.
+func drainHost(host net.Conn) error {
+	buf := comm.Buffer(models.TCP_BUFFER_SIZE)
+	defer comm.Recycle(buf)
+	stopping := false
+	for !stopping {
+		got := 0
+		for got < comm.HeaderSize {
+			n, err := host.Read(buf[got:comm.HeaderSize])
+			got += n
+			if err == nil {
+				continue
+			}
+			if !isTimeout(err) {
+				return errors.Wrap(err, "Host is gone")
+			}
+			if got == 0 {
+				// Told to stop between frames
+				return nil
+			}
+			stopping = true
+			host.SetReadDeadline(time.Time{})
+		}
+
+		remaining := int(binary.LittleEndian.Uint32(buf))
+		log.Debugf("Dropping a frame of %d bytes the host sent nobody", remaining)
+		for remaining > 0 {
+			n := len(buf)
+			if n > remaining {
+				n = remaining
+			}
+			m, err := host.Read(buf[:n])
+			remaining -= m
+			if err != nil {
+				if !isTimeout(err) {
+					return errors.Wrap(err, "Host is gone")
+				}
+				// Too late to stop, this frame is dropped whole first
+				stopping = true
+				host.SetReadDeadline(time.Time{})
+			}
+		}
+	}
+	return nil
+}
+
+// stopDraining stops drainHost reporting to drained, if it is running, and returns what it did
+func stopDraining(host net.Conn, drained <-chan error) error {
+	if drained == nil {
+		return nil
+	}
+	host.SetReadDeadline(time.Now())
+	err := <-drained
+	host.SetReadDeadline(time.Time{})
+	return err
+}
+
+// forwardClient relays whole frames from client to host.
+// It returns an error only if the host is gone.
+func forwardClient(host, client net.Conn, stats *roomStats) error {
+	var header [comm.HeaderSize]byte
+	for {
+		if _, err := readFull(client, header[:]); err != nil {
+			log.Debugf("Client is done: %s", err)
+			return nil
+		}
+		size := int(binary.LittleEndian.Uint32(header[:]))
+		if size > maxClientFrame {
+			log.Debugf("Client sent a frame of %d bytes", size)
+			return nil
+		}
+		frame := comm.Buffer(comm.HeaderSize + size)
+		copy(frame, header[:])
+		if _, err := readFull(client, frame[comm.HeaderSize:]); err != nil {
+			comm.Recycle(frame)
+			log.Debugf("Client left halfway through a frame: %s", err)
+			return nil
+		}
+		if relayControl(frame[comm.HeaderSize:]) {
+			// Only the relay speaks for the relay, the host would take it at its word
+			comm.Recycle(frame)
+			log.Warnf("Client %s sent a relay control frame", client.RemoteAddr())
+			return nil
+		}
+		err := send(host, frame, stats.toHostLimit, &stats.toHost, "to_host", stats)
+		comm.Recycle(frame)
+		if err != nil {
+			return errors.Wrap(err, "Host is gone")
+		}
+	}
+}
+
+// relayControl tells whether a frame starts like one only the relay may send
+func relayControl(frame []byte) bool {
+	return bytes.HasPrefix(frame, closeNoticePrefix) || bytes.HasPrefix(frame, peerInfoPrefix)
+}
+
+// readFull is io.ReadFull without its io.ErrUnexpectedEOF, the bridge only cares that it failed
+func readFull(conn net.Conn, b []byte) (n int, err error) {
+	for n < len(b) && err == nil {
+		var m int
+		m, err = conn.Read(b[n:])
+		n += m
+	}
+	if n == len(b) {
+		err = nil
+	}
+	return
+}
+
+// send writes b to conn in a single write, throttled and counted
+func send(conn net.Conn, b []byte, limit *tokenBucket, counter *uint64, direction string, stats *roomStats) error {
+	limit.wait(len(b))
+	n, err := conn.Write(b)
+	atomic.AddUint64(counter, uint64(n))
+	atomic.StoreInt64(&stats.lastActive, time.Now().UnixNano())
+	bridgeBytes.Add(float64(n), direction)
+	if err == nil && n < len(b) {
+		err = errors.Errorf("wanted to write %d but wrote %d", len(b), n)
+	}
+	return err
+}
@@ -0,0 +1,109 @@
+package tcp2
+
+import (
+	"bytes"
+	"sync/atomic"
+	"time"
+
+	"github.com/miska12345/MiskaRFS/src/comm"
+	log "github.com/miska12345/MiskaRFS/src/logger"
+)
+
+// RoomPolicy decides when the relay closes rooms on its own, zero values mean never
+type RoomPolicy struct {
+	// MaxLifetime closes a room this long after its host registered it
+	MaxLifetime time.Duration
+	// ClientIdle drops a bridged client after this long without a frame in either direction
+	ClientIdle time.Duration
+	// HostIdle closes a room that has gone this long without a client
+	HostIdle time.Duration
+}
+
+// Reasons the relay gives when it closes a room or drops a client
+const (
+	REASON_EXPIRED     = "expired"
+	REASON_CLIENT_IDLE = "client_idle"
+	REASON_HOST_IDLE   = "host_idle"
+	REASON_CLOSED      = "closed"
+	REASON_KICKED      = "kicked"
+)
+
+// closeNoticePrefix starts the last frame a peer gets before the relay hangs up on it.
+// Heartbeats are a single byte and everything else is JSON or ciphertext, so this can't be mistaken for either.
+var closeNoticePrefix = []byte("\x02miskarfs-relay-close:")
+
+// how long to try telling a peer why it is being dropped
+const closeNoticeTimeout = time.Second
+
+// RoomClosedError is returned by hosts and clients when the relay closed their room
+type RoomClosedError struct {
+	Reason string
+}
+
+func (e *RoomClosedError) Error() string {
+	return "Relay closed the room: " + e.Reason
+}
+
+// ParseCloseNotice returns the reason the relay gave if data is its close notice, nil otherwise
+func ParseCloseNotice(data []byte) *RoomClosedError {
+	if !bytes.HasPrefix(data, closeNoticePrefix) {
+		return nil
+	}
+	return &RoomClosedError{Reason: string(data[len(closeNoticePrefix):])}
+}
+
+// closeWithReason tells the peer why before hanging up, without waiting on a peer that doesn't read
+func closeWithReason(c *comm.Comm, reason string) {
+	if reason != "" {
+		c.SetTimeouts(comm.Timeouts{Write: closeNoticeTimeout})
+		notice := append(append([]byte{}, closeNoticePrefix...), reason...)
+		if err := c.Send(notice); err != nil {
+			log.Debugf("Could not send close notice: %s", err)
+		}
+	}
+	c.Close()
+}
+
+// expireRooms enforces the policy every tick until done is closed
+func (s *server) expireRooms(policy RoomPolicy, tick time.Duration, done chan struct{}) {
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			s.expire(policy, now)
+		}
+	}
+}
+
+func (s *server) expire(policy RoomPolicy, now time.Time) {
+	closeRooms := make(map[string]string)
+	var idleClients []string
+	s.rooms.Lock()
+	for name, info := range s.rooms.rooms {
+		switch {
+		case policy.MaxLifetime > 0 && now.Sub(info.opened) > policy.MaxLifetime:
+			closeRooms[name] = REASON_EXPIRED
+		case policy.HostIdle > 0 && info.state == STATE_WAITING && now.Sub(info.idleSince) > policy.HostIdle:
+			closeRooms[name] = REASON_HOST_IDLE
+		case policy.ClientIdle > 0 && info.state == STATE_BRIDGED:
+			// Clients waiting for the bridge to open aren't idle yet
+			last := atomic.LoadInt64(&info.stats.lastActive)
+			if last != 0 && now.Sub(time.Unix(0, last)) > policy.ClientIdle {
+				idleClients = append(idleClients, name)
+			}
+		}
+	}
+	s.rooms.Unlock()
+
+	for name, reason := range closeRooms {
+		log.Infof("Closing room %s: %s", name, reason)
+		s.deleteRoom(name, reason)
+	}
+	for _, name := range idleClients {
+		log.Infof("Dropping idle client of room %s", name)
+		s.kickClient(name, REASON_CLIENT_IDLE)
+	}
+}
@@ -0,0 +1,252 @@
+package tcp2
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miska12345/MiskaRFS/src/comm"
+	log "github.com/miska12345/MiskaRFS/src/logger"
+	"github.com/miska12345/MiskaRFS/src/models"
+)
+
+// Limits protect the relay from misbehaving peers, zero values mean unlimited
+type Limits struct {
+	// MaxConnections caps connections open at once
+	MaxConnections int
+	// MaxConnectionsPerIP caps connections open at once from one address
+	MaxConnectionsPerIP int
+	// HandshakesPerSecond is how often one address may start a handshake, with bursts of HandshakeBurst
+	HandshakesPerSecond float64
+	HandshakeBurst      int
+	// RoomBytesPerSecond caps the bridge of each room in each direction
+	RoomBytesPerSecond int
+	// BanAfterBadPasswords bans an address for BanDuration after that many bad passwords in a row
+	BanAfterBadPasswords int
+	BanDuration          time.Duration
+}
+
+// limiter keeps the per address state needed to enforce Limits
+type limiter struct {
+	limits     Limits
+	total      int
+	conns      map[string]int
+	handshakes map[string]*tokenBucket
+	failures   map[string]int
+	bans       map[string]time.Time
+	sync.Mutex
+}
+
+func newLimiter(limits Limits) *limiter {
+	if limits.BanAfterBadPasswords > 0 && limits.BanDuration == 0 {
+		limits.BanDuration = 10 * time.Minute
+	}
+	if limits.HandshakesPerSecond > 0 && limits.HandshakeBurst == 0 {
+		limits.HandshakeBurst = 1
+	}
+	return &limiter{
+		limits:     limits,
+		conns:      make(map[string]int),
+		handshakes: make(map[string]*tokenBucket),
+		failures:   make(map[string]int),
+		bans:       make(map[string]time.Time),
+	}
+}
+
+// addressOf strips the port from a remote address
+func addressOf(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// admit decides whether to serve a new connection.
+// Admitted connections are wrapped to give their slot back when closed.
+func (l *limiter) admit(conn net.Conn) (net.Conn, string) {
+	ip := addressOf(conn)
+	now := time.Now()
+	l.Lock()
+	defer l.Unlock()
+
+	if until, ok := l.bans[ip]; ok {
+		if now.Before(until) {
+			return nil, "banned"
+		}
+		delete(l.bans, ip)
+	}
+	if l.limits.MaxConnections > 0 && l.total >= l.limits.MaxConnections {
+		return nil, "max_connections"
+	}
+	if l.limits.MaxConnectionsPerIP > 0 && l.conns[ip] >= l.limits.MaxConnectionsPerIP {
+		return nil, "max_connections_per_ip"
+	}
+	if l.limits.HandshakesPerSecond > 0 {
+		b, ok := l.handshakes[ip]
+		if !ok {
+			if len(l.handshakes) > 10000 {
+				l.pruneHandshakes()
+			}
+			b = newTokenBucket(l.limits.HandshakesPerSecond, float64(l.limits.HandshakeBurst))
+			l.handshakes[ip] = b
+		}
+		if !b.allow() {
+			return nil, "handshake_rate"
+		}
+	}
+
+	l.total++
+	l.conns[ip]++
+	return &limitedConn{Conn: conn, release: func() { l.release(ip) }}, ""
+}
+
+func (l *limiter) release(ip string) {
+	l.Lock()
+	l.total--
+	l.conns[ip]--
+	if l.conns[ip] <= 0 {
+		delete(l.conns, ip)
+	}
+	l.Unlock()
+}
+
+// pruneHandshakes forgets addresses whose bucket refilled, the caller must hold the lock
+func (l *limiter) pruneHandshakes() {
+	for ip, b := range l.handshakes {
+		if b.full() {
+			delete(l.handshakes, ip)
+		}
+	}
+}
+
+// badPassword records a failed login and bans the address if it keeps failing
+func (l *limiter) badPassword(conn net.Conn) {
+	if l.limits.BanAfterBadPasswords <= 0 {
+		return
+	}
+	ip := addressOf(conn)
+	l.Lock()
+	defer l.Unlock()
+	l.failures[ip]++
+	if l.failures[ip] >= l.limits.BanAfterBadPasswords {
+		log.Warnf("Banning %s for %s after %d bad passwords", ip, l.limits.BanDuration, l.failures[ip])
+		delete(l.failures, ip)
+		l.bans[ip] = time.Now().Add(l.limits.BanDuration)
+	}
+}
+
+func (l *limiter) goodPassword(conn net.Conn) {
+	l.Lock()
+	delete(l.failures, addressOf(conn))
+	l.Unlock()
+}
+
+// Guard puts Limits on the clients of a host accepting them itself, as the relay puts them on its own.
+// RoomBytesPerSecond is left to the host.
+type Guard struct {
+	limiter *limiter
+}
+
+// NewGuard returns a guard keeping to limits
+func NewGuard(limits Limits) *Guard {
+	return &Guard{limiter: newLimiter(limits)}
+}
+
+// Admit decides whether to serve a new connection, returning nil and why if not.
+// Admitted connections are wrapped to give their slot back when closed.
+func (g *Guard) Admit(conn net.Conn) (net.Conn, string) {
+	return g.limiter.admit(conn)
+}
+
+// AcceptClient is AcceptClient counting bad passwords against the address of c
+func (g *Guard) AcceptClient(c *comm.Comm, password, room string) error {
+	err := AcceptClient(c, password, room)
+	switch err {
+	case nil:
+		g.limiter.goodPassword(c.Connection())
+	case errBadPassword:
+		g.limiter.badPassword(c.Connection())
+	}
+	return err
+}
+
+// roomBucket returns the throttle for one direction of a room's bridge, nil if unlimited
+func (l *limiter) roomBucket() *tokenBucket {
+	if l.limits.RoomBytesPerSecond <= 0 {
+		return nil
+	}
+	burst := l.limits.RoomBytesPerSecond
+	if burst < models.TCP_BUFFER_SIZE {
+		burst = models.TCP_BUFFER_SIZE
+	}
+	return newTokenBucket(float64(l.limits.RoomBytesPerSecond), float64(burst))
+}
+
+type limitedConn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// tokenBucket refills at rate tokens per second up to burst
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	sync.Mutex
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// refill must be called with the lock held
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// allow takes a token if there is one
+func (b *tokenBucket) allow() bool {
+	b.Lock()
+	defer b.Unlock()
+	b.refill()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// wait takes n tokens, sleeping until the bucket has paid them off
+func (b *tokenBucket) wait(n int) {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	b.refill()
+	b.tokens -= float64(n)
+	debt := b.tokens
+	b.Unlock()
+	if debt < 0 {
+		time.Sleep(time.Duration(-debt / b.rate * float64(time.Second)))
+	}
+}
+
+func (b *tokenBucket) full() bool {
+	b.Lock()
+	defer b.Unlock()
+	b.refill()
+	return b.tokens >= b.burst
+}
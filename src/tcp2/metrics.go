@@ -0,0 +1,14 @@
+package tcp2
+
+import "github.com/miska12345/MiskaRFS/src/metrics"
+
+var (
+	handshakes = metrics.Default.Counter("miskarfs_relay_handshakes_total",
+		"Relay handshakes by result.", "result")
+	roomsActive = metrics.Default.Gauge("miskarfs_relay_rooms_active",
+		"Rooms currently open on the relay.")
+	bridgeBytes = metrics.Default.Counter("miskarfs_relay_bridge_bytes_total",
+		"Bytes bridged between hosts and clients by direction.", "direction")
+	rejected = metrics.Default.Counter("miskarfs_relay_rejected_connections_total",
+		"Connections turned away before the handshake by reason.", "reason")
+)
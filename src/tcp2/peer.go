@@ -0,0 +1,47 @@
+package tcp2
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/miska12345/MiskaRFS/src/comm"
+)
+
+// PeerInfo tells a peer where the other end of its room might be reached without the relay.
+// It is only sent when both ends gave the relay Addresses.
+type PeerInfo struct {
+	// Observed is the address the relay sees the other peer at
+	Observed string
+	// Addresses are where the other peer says it accepts direct connections
+	Addresses []string
+	// Self is the address the relay sees this peer at
+	Self string
+}
+
+// peerInfoPrefix starts a PeerInfo frame, sent to the host and to the client before "ok"
+var peerInfoPrefix = []byte("\x03miskarfs-relay-peer:")
+
+// ParsePeerInfo returns the PeerInfo in data, nil if data is something else
+func ParsePeerInfo(data []byte) *PeerInfo {
+	if !bytes.HasPrefix(data, peerInfoPrefix) {
+		return nil
+	}
+	info := new(PeerInfo)
+	if err := json.Unmarshal(data[len(peerInfoPrefix):], info); err != nil {
+		return nil
+	}
+	return info
+}
+
+// sendPeerInfo tells to where to find other
+func sendPeerInfo(to, other *comm.Comm, addresses []string) error {
+	bys, err := json.Marshal(PeerInfo{
+		Observed:  other.Connection().RemoteAddr().String(),
+		Addresses: addresses,
+		Self:      to.Connection().RemoteAddr().String(),
+	})
+	if err != nil {
+		return err
+	}
+	return to.Send(append(append([]byte{}, peerInfoPrefix...), bys...))
+}
@@ -0,0 +1,181 @@
+package tcp2
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/miska12345/MiskaRFS/src/comm"
+	log "github.com/miska12345/MiskaRFS/src/logger"
+	"github.com/miska12345/MiskaRFS/src/models"
+	"github.com/schollz/croc/v8/src/crypt"
+)
+
+// Types of RoomRequest
+const (
+	REQ_JOIN = "join"
+	REQ_HOST = "host"
+	REQ_LIST = "list"
+)
+
+// Room visibility chosen by the host at registration
+const (
+	VISIBILITY_PUBLIC   = "public"
+	VISIBILITY_UNLISTED = "unlisted"
+)
+
+// RoomRequest is sent to the relay after authenticating.
+// A bare room name is still understood as a join.
+type RoomRequest struct {
+	Type         string
+	Room         string
+	Visibility   string
+	Capabilities []string
+	// Addresses are where the peer accepts direct connections, the relay passes them on to the other end
+	Addresses []string
+}
+
+// RoomStatus describes a live room in a listing
+type RoomStatus struct {
+	Name         string
+	Uptime       time.Duration
+	Clients      int
+	Capabilities []string
+}
+
+// parseRoomRequest understands both JSON requests and bare room names
+func parseRoomRequest(buf []byte) (req RoomRequest) {
+	if len(buf) > 0 && buf[0] == '{' && json.Unmarshal(buf, &req) == nil && req.Type != "" {
+		return
+	}
+	return RoomRequest{Type: REQ_JOIN, Room: string(buf)}
+}
+
+// listRooms answers a REQ_LIST with the public rooms
+func (s *server) listRooms(conn *comm.Comm, key []byte) error {
+	list := []RoomStatus{}
+	s.rooms.Lock()
+	for name, info := range s.rooms.rooms {
+		if info.visibility != VISIBILITY_PUBLIC {
+			continue
+		}
+		status := RoomStatus{
+			Name:         name,
+			Uptime:       time.Since(info.opened).Truncate(time.Second),
+			Capabilities: info.capabilities,
+		}
+		if info.client != nil {
+			status.Clients = 1
+		}
+		list = append(list, status)
+	}
+	s.rooms.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	log.Debugf("Listing %d rooms", len(list))
+
+	bys, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	bys, err = crypt.Encrypt(bys, key)
+	if err != nil {
+		return err
+	}
+	return conn.Send(bys)
+}
+
+// RegisterHost claims a room on the relay as its host, failing if the room is taken
+func RegisterHost(transport comm.Transport, address, password string, req *RoomRequest, timelimit ...time.Duration) (c *comm.Comm, err error) {
+	r := *req
+	r.Type = REQ_HOST
+	bys, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	return joinRoom(transport, address, password, bys, timelimit...)
+}
+
+// JoinRoom joins a room as its client with the details in req
+func JoinRoom(transport comm.Transport, address, password string, req *RoomRequest, timelimit ...time.Duration) (c *comm.Comm, err error) {
+	r := *req
+	r.Type = REQ_JOIN
+	bys, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	return joinRoom(transport, address, password, bys, timelimit...)
+}
+
+// AcceptClient answers a client that dialed a host directly the way the relay would,
+// so that the same client reaches either. It fails unless the client joins room.
+func AcceptClient(c *comm.Comm, password, room string) (err error) {
+	c.SetMaxFrameSize(models.TCP_BUFFER_SIZE)
+	c.SetTimeouts(handshakeTimeouts)
+	key, err := authenticate(c, password)
+	if err != nil {
+		return
+	}
+	buf, err := c.Receive()
+	if err != nil {
+		return
+	}
+	buf, err = crypt.Decrypt(buf, key)
+	if err != nil {
+		return
+	}
+	reply := "client"
+	if req := parseRoomRequest(buf); req.Type != REQ_JOIN || req.Room != room {
+		reply = "not found"
+		err = fmt.Errorf("Client wanted %s room %s", req.Type, req.Room)
+	}
+	buf, e := crypt.Encrypt([]byte(reply), key)
+	if e == nil {
+		e = c.Send(buf)
+	}
+	if err != nil {
+		return
+	}
+	if e != nil {
+		return e
+	}
+	c.SetMaxFrameSize(comm.DefaultMaxFrameSize)
+	c.SetTimeouts(comm.DefaultTimeouts)
+	// Nothing to wait for, the host is right here
+	return c.Send([]byte("ok"))
+}
+
+// ListRooms asks the relay for its public rooms
+func ListRooms(transport comm.Transport, address, password string, timelimit ...time.Duration) (rooms []RoomStatus, err error) {
+	c, key, err := dialRelay(transport, address, password, timelimit...)
+	if err != nil {
+		return
+	}
+	defer c.Close()
+
+	bys, err := json.Marshal(RoomRequest{Type: REQ_LIST})
+	if err != nil {
+		return
+	}
+	bys, err = crypt.Encrypt(bys, key)
+	if err != nil {
+		return
+	}
+	if err = c.Send(bys); err != nil {
+		return
+	}
+	bys, err = c.Receive()
+	if err != nil {
+		return
+	}
+	bys, err = crypt.Decrypt(bys, key)
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(bys, &rooms); err != nil {
+		return nil, fmt.Errorf("Could not list rooms: %s", bys)
+	}
+	return
+}
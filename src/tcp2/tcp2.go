@@ -2,14 +2,17 @@ package tcp2
 
 import (
 	"bytes"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miska12345/MiskaRFS/src/comm"
 	log "github.com/miska12345/MiskaRFS/src/logger"
+	"github.com/miska12345/MiskaRFS/src/metrics"
 	"github.com/miska12345/MiskaRFS/src/models"
 	"github.com/pkg/errors"
 	"github.com/schollz/croc/v8/src/crypt"
@@ -21,55 +24,261 @@ type server struct {
 	banner   string
 	password string
 	rooms    roomMap
+	limiter  *limiter
 }
 
+// Room states. A room goes back to waiting when its client leaves and never leaves closed.
+const (
+	// STATE_WAITING rooms have a host waiting for a client
+	STATE_WAITING = "waiting"
+	// STATE_BRIDGED rooms pass frames between host and client
+	STATE_BRIDGED = "bridged"
+	// STATE_DRAINING rooms are losing their client and finish the frames in flight
+	STATE_DRAINING = "draining"
+	// STATE_CLOSED rooms are gone from the relay, their owner is hanging up
+	STATE_CLOSED = "closed"
+)
+
+// roomInfo is a room on the relay. It is owned by its host's goroutine, which is the only one
+// to read or write the host and the bridged client; everyone else asks through the channels.
+// client, state, idleSince and reason are guarded by the roomMap lock.
 type roomInfo struct {
-	host     *comm.Comm
-	client   *comm.Comm
-	hostChan chan []byte
-	opened   time.Time
-	full     bool
+	name         string
+	host         *comm.Comm
+	client       *comm.Comm
+	state        string
+	opened       time.Time
+	idleSince    time.Time
+	visibility   string
+	capabilities []string
+	stats        *roomStats
+
+	// addresses are where the host accepts direct connections
+	addresses []string
+
+	// join hands a client to the owner
+	join chan joiner
+	// kick asks the owner to drop a client
+	kick chan kickRequest
+	// done is closed when the room closes, reason says why
+	done   chan struct{}
+	reason string
+}
+
+type joiner struct {
+	conn      *comm.Comm
+	addresses []string
+}
+
+type kickRequest struct {
+	client *comm.Comm
+	reason string
+}
+
+// roomStats counts bridged bytes and when they last moved, updated atomically by the bridge,
+// and throttles them if the relay has a bandwidth limit
+type roomStats struct {
+	toClient      uint64
+	toHost        uint64
+	lastActive    int64
+	toClientLimit *tokenBucket
+	toHostLimit   *tokenBucket
 }
 
 type roomMap struct {
-	rooms map[string]roomInfo
+	rooms map[string]*roomInfo
 	sync.Mutex
 }
 
-type roomRole struct {
-	room string
-	role string
+// Config configures a relay
+type Config struct {
+	// Port is the TCP port to listen on, leave empty to not listen on TCP
+	Port string
+	// WebSocket is a ws:// URL to also accept WebSocket connections on, e.g. ws://:8081/relay
+	WebSocket string
+	// Listeners are extra listeners to accept connections from, e.g. from a comm.Transport
+	Listeners  []net.Listener
+	DebugLevel string
+	Password   string
+
+	// TLSCertFile and TLSKeyFile turn on TLS for Port and Listeners
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSClientCAFile makes clients present a certificate signed by this CA
+	TLSClientCAFile string
+	// TLSSelfSigned turns on TLS with a throwaway self-signed certificate, for development only
+	TLSSelfSigned bool
+
+	// AdminAddress or AdminListener turn on the admin HTTP API and dashboard, e.g. 127.0.0.1:8090
+	AdminAddress  string
+	AdminListener net.Listener
+	// AdminToken must be sent as a bearer token to use the admin API
+	AdminToken string
+
+	// MetricsAddress serves Prometheus metrics at /metrics, e.g. 127.0.0.1:9100
+	MetricsAddress string
+
+	// Limits caps connections, handshakes and bandwidth, unlimited by default
+	Limits Limits
+	// Policy closes expired and idle rooms, rooms live forever by default
+	Policy RoomPolicy
 }
 
 // Run Relay server
 func Run(port, debugLevel, password string) error {
-	log.SetLevel(debugLevel)
+	return RunWithConfig(&Config{
+		Port:       port,
+		DebugLevel: debugLevel,
+		Password:   password,
+	})
+}
+
+// Serve runs the relay on connections accepted from listener
+func Serve(listener net.Listener, debugLevel, password string) error {
+	return RunWithConfig(&Config{
+		Listeners:  []net.Listener{listener},
+		DebugLevel: debugLevel,
+		Password:   password,
+	})
+}
+
+// RunWithConfig runs the relay on every listener the config asks for
+func RunWithConfig(config *Config) (err error) {
+	log.SetLevel(config.DebugLevel)
 
 	s := new(server)
-	s.port = port
+	s.port = config.Port
 	s.banner = "ok"
-	s.password = password
-	return s.start()
+	s.password = config.Password
+	s.limiter = newLimiter(config.Limits)
+
+	listeners := append([]net.Listener{}, config.Listeners...)
+	if config.Port != "" {
+		log.Infof("starting TCP server on " + config.Port)
+		listener, err := net.Listen("tcp", ":"+config.Port)
+		if err != nil {
+			err = errors.Wrap(err, "Error listening on :"+config.Port)
+			log.Error(err)
+			closeAll(listeners)
+			return err
+		}
+		listeners = append(listeners, listener)
+	}
+	tlsConfig, err := config.tlsConfig()
+	if err != nil {
+		log.Error(err)
+		closeAll(listeners)
+		return err
+	}
+	if tlsConfig != nil {
+		for i := range listeners {
+			listeners[i] = tls.NewListener(listeners[i], tlsConfig)
+		}
+	}
+	if config.WebSocket != "" {
+		log.Infof("starting WebSocket server on " + config.WebSocket)
+		listener, err := comm.WebSocket.Listen(config.WebSocket)
+		if err != nil {
+			err = errors.Wrap(err, "Error listening on "+config.WebSocket)
+			log.Error(err)
+			closeAll(listeners)
+			return err
+		}
+		listeners = append(listeners, listener)
+	}
+	if len(listeners) == 0 {
+		return fmt.Errorf("Nothing to listen on")
+	}
+
+	adminListener := config.AdminListener
+	if adminListener == nil && config.AdminAddress != "" {
+		adminListener, err = net.Listen("tcp", config.AdminAddress)
+		if err != nil {
+			err = errors.Wrap(err, "Error listening on "+config.AdminAddress)
+			log.Error(err)
+			closeAll(listeners)
+			return err
+		}
+	}
+	if config.MetricsAddress != "" {
+		metricsListener, err := metrics.Serve(config.MetricsAddress)
+		if err != nil {
+			if adminListener != nil {
+				adminListener.Close()
+			}
+			closeAll(listeners)
+			return errors.Wrap(err, "Error listening on "+config.MetricsAddress)
+		}
+		defer metricsListener.Close()
+	}
+	if adminListener != nil {
+		if config.AdminToken == "" {
+			adminListener.Close()
+			closeAll(listeners)
+			return fmt.Errorf("The admin API needs an AdminToken")
+		}
+		defer adminListener.Close()
+		go s.serveAdmin(adminListener, config.AdminToken)
+	}
+	if config.Policy != (RoomPolicy{}) {
+		done := make(chan struct{})
+		defer close(done)
+		go s.expireRooms(config.Policy, time.Second, done)
+	}
+	return s.start(listeners)
+}
+
+// tlsConfig returns nil when TLS is off
+func (config *Config) tlsConfig() (*tls.Config, error) {
+	if config.TLSSelfSigned {
+		cert, err := comm.SelfSignedCertificate("localhost", "127.0.0.1", "::1")
+		if err != nil {
+			return nil, err
+		}
+		log.Warn("TLS is using a self-signed certificate, clients can't verify who they talk to")
+		return &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}, nil
+	}
+	if config.TLSCertFile == "" && config.TLSKeyFile == "" {
+		if config.TLSClientCAFile != "" {
+			return nil, fmt.Errorf("TLSClientCAFile needs TLSCertFile and TLSKeyFile")
+		}
+		return nil, nil
+	}
+	tlsConfig, err := comm.ServerTLSConfig(config.TLSCertFile, config.TLSKeyFile, config.TLSClientCAFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error loading TLS certificate")
+	}
+	return tlsConfig, nil
+}
+
+func closeAll(listeners []net.Listener) {
+	for _, l := range listeners {
+		l.Close()
+	}
 }
 
-func (s *server) start() (err error) {
+func (s *server) start(listeners []net.Listener) (err error) {
 	s.rooms.Lock()
-	s.rooms.rooms = make(map[string]roomInfo)
+	s.rooms.rooms = make(map[string]*roomInfo)
 	s.rooms.Unlock()
 
-	err = s.run()
-	if err != nil {
-		log.Error(err)
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			errs <- s.run(l)
+		}(l)
 	}
+	// One listener failing takes the whole relay down
+	err = <-errs
+	closeAll(listeners)
+	log.Error(err)
 	return
 }
 
-func (s *server) run() error {
-	log.Infof("starting TCP server on " + s.port)
-	server, err := net.Listen("tcp", ":"+s.port)
-	if err != nil {
-		return errors.Wrap(err, "Error listening on :"+s.port)
-	}
+func (s *server) run(server net.Listener) error {
 	defer server.Close()
 	// spawn a new goroutine whenever a client connects
 	for {
@@ -78,247 +287,348 @@ func (s *server) run() error {
 			return errors.Wrap(err, "problem accepting connection")
 		}
 		log.Debugf("client %s connected", connection.RemoteAddr().String())
+		limited, reason := s.limiter.admit(connection)
+		if limited == nil {
+			log.Debugf("Turning away %s: %s", connection.RemoteAddr(), reason)
+			rejected.Inc(reason)
+			connection.Close()
+			continue
+		}
+		connection = limited
 		go s.perClientCommunication(s.port, connection)
 	}
 }
 
 func (s *server) perClientCommunication(port string, conn net.Conn) {
 	c := comm.New(conn)
-	key, err := s.authenticate(c)
+	// Nothing in the handshake comes close to this, don't let strangers make us allocate more
+	c.SetMaxFrameSize(models.TCP_BUFFER_SIZE)
+	// Nor let them hold a connection open without finishing it
+	c.SetTimeouts(handshakeTimeouts)
+	key, err := authenticate(c, s.password)
 	if err != nil {
 		log.Debug(err)
+		if err == errBadPassword {
+			s.limiter.badPassword(conn)
+		}
+		handshakes.Inc("failed")
+		c.Close()
 		return
 	}
-	room, err := s.setupRoom(key, c)
+	s.limiter.goodPassword(conn)
+	handshakes.Inc("succeeded")
+	room, role, err := s.setupRoom(key, c)
 	if err != nil {
 		log.Debug(err)
+		c.Close()
 		return
 	}
-	if room.role == "host" {
-		for {
-			// Wait until a client comes
-			deleteIt := false
+	switch role {
+	case "host":
+		s.serveRoom(room)
+	case "client":
+		// The room's owner has it now
+	default:
+		// Turned away or only asking for something
+		c.Close()
+	}
+}
+
+// heartbeatInterval is how often a waiting host is checked on
+var heartbeatInterval = 2 * time.Second
+
+// serveRoom owns a room and its connections until the room closes
+func (s *server) serveRoom(r *roomInfo) {
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	// Nothing the host sends while the room waits has anyone to go to
+	drain := func() chan error {
+		drained := make(chan error, 1)
+		go func() {
+			drained <- drainHost(r.host.Connection())
+		}()
+		return drained
+	}
+	drained := drain()
+	for {
+		select {
+		case <-r.done:
+			stopDraining(r.host.Connection(), drained)
+			// Nobody can join a closed room, but someone may have just done so
 			s.rooms.Lock()
-			if _, ok := s.rooms.rooms[room.room]; !ok {
-				// Room is gone
-				s.rooms.Unlock()
-				log.Debug("Room is gone")
-				return
+			var client joiner
+			select {
+			case client = <-r.join:
+			default:
 			}
-			if s.rooms.rooms[room.room].host != nil && s.rooms.rooms[room.room].client != nil {
-				// Ready to talk!
-				log.Debug("Ready to talk!")
-				s.rooms.Unlock()
-				s.bridge(s.rooms.rooms[room.room].host, s.rooms.rooms[room.room].client, s.rooms.rooms[room.room].hostChan, key, room.room)
-				log.Debug("%v", s.rooms.rooms[room.room])
-			} else if s.rooms.rooms[room.room].host != nil {
-				//log.Debug("Waiting for client...")
-				err = s.rooms.rooms[room.room].host.Send([]byte{1})
-				if err != nil {
-					deleteIt = true
-					log.Warn("Host is gone")
-				}
-				s.rooms.Unlock()
-			} else {
-				deleteIt = true
-				s.rooms.Unlock()
+			s.rooms.Unlock()
+			if client.conn != nil {
+				closeWithReason(client.conn, r.reason)
 			}
-
-			if deleteIt {
-				s.deleteRoom(room.room)
-				break
+			closeWithReason(r.host, r.reason)
+			log.Debugf("Room %s closed", r.name)
+			return
+		case <-heartbeat.C:
+			if err := r.host.Send([]byte{1}); err != nil {
+				log.Warn("Host is gone")
+				s.deleteRoom(r.name, "")
+			}
+		case err := <-drained:
+			drained = nil
+			log.Warn(err)
+			s.deleteRoom(r.name, "")
+		case client := <-r.join:
+			if err := stopDraining(r.host.Connection(), drained); err != nil {
+				log.Warn(err)
+				client.conn.Close()
+				s.deleteRoom(r.name, "")
+				drained = nil
+				continue
 			}
-			time.Sleep(2 * time.Second)
+			s.bridge(r, client)
+			drained = drain()
 		}
 	}
-	// Client perCom will exit
 }
 
-func (s *server) bridge(host, client *comm.Comm, hostChan chan []byte, strongKeyForEncryption []byte, room string) {
-	log.Debugf("BRIDGE %v == %v", host, client)
-
-	var wg sync.WaitGroup
-	var deleteIt bool
-	wg.Add(1)
-	// start piping
-	go func(com1, com2 *comm.Comm, wg *sync.WaitGroup) {
-		log.Debug("starting pipes")
-		err := pipe(host.Connection(), hostChan, client.Connection())
-		wg.Done()
-		deleteIt = err != nil
-		log.Debug("done piping")
-	}(host, client, &wg)
-
-	err := client.Send([]byte("ok"))
-	if err != nil {
-		s.deleteRoom(room)
-		log.Error(err)
-		return
-	}
-
-	wg.Wait()
-	log.Debug("finish waiting")
-	if deleteIt {
-		log.Debug("Room will be deleted")
-		s.deleteRoom(room)
-		return
-	} else {
-		log.Debug("Room will be preserved")
-		s.rooms.Lock()
-		s.rooms.rooms[room] = roomInfo{
-			host:     s.rooms.rooms[room].host,
-			client:   nil,
-			hostChan: s.rooms.rooms[room].hostChan,
-			opened:   s.rooms.rooms[room].opened,
-			full:     false,
+// bridge connects the room's host with client until one of them leaves or the room is told to stop
+func (s *server) bridge(r *roomInfo, j joiner) {
+	log.Debugf("Bridging room %s", r.name)
+	client := j.conn
+	// Idle time counts from the bridge opening
+	atomic.StoreInt64(&r.stats.lastActive, time.Now().UnixNano())
+	if len(r.addresses) > 0 && len(j.addresses) > 0 {
+		// Both could do without us, tell each where to find the other
+		if err := sendPeerInfo(r.host, client, j.addresses); err != nil {
+			log.Debug(err)
+			s.deleteRoom(r.name, "")
+			client.Close()
+			return
 		}
-		s.rooms.Unlock()
-		log.Debug("Client left")
+		if err := sendPeerInfo(client, r.host, r.addresses); err != nil {
+			log.Debug(err)
+			s.clientLeft(r, client, "")
+			return
+		}
+	}
+	if err := client.Send([]byte("ok")); err != nil {
+		log.Debug(err)
+		s.clientLeft(r, client, "")
 		return
 	}
-}
-
-// chanFromConn creates a channel from a Conn object, and sends everything it
-//  Read()s from the socket to the channel.
-func chanFromConn(conn net.Conn) chan []byte {
-	c := make(chan []byte, 1)
 
+	stop := make(chan struct{})
+	ended := make(chan struct{})
+	why := make(chan string, 1)
 	go func() {
-		b := make([]byte, models.TCP_BUFFER_SIZE)
-
+		defer close(stop)
 		for {
-			n, err := conn.Read(b)
-			if n > 0 {
-				res := make([]byte, n)
-				// Copy the buffer so it doesn't get changed while read by the recipient.
-				copy(res, b[:n])
-				c <- res
-			}
-			if err != nil {
-				log.Debugf("chan: %s", err)
-				c <- nil
-				break
+			select {
+			case k := <-r.kick:
+				if k.client != client {
+					// Meant for a client that already left
+					continue
+				}
+				why <- k.reason
+			case <-r.done:
+				why <- r.reason
+			case <-ended:
+				why <- ""
 			}
+			return
 		}
-		log.Debug("exiting")
 	}()
+	err := bridgeConns(r.host.Connection(), client.Connection(), r.stats, stop, func() {
+		s.setState(r, STATE_DRAINING)
+	})
+	close(ended)
+	reason := <-why
 
-	return c
+	select {
+	case <-r.done:
+		// serveRoom tells the host
+		closeWithReason(client, r.reason)
+		return
+	default:
+	}
+	if err != nil {
+		log.Debugf("Room will be deleted: %s", err)
+		client.Close()
+		s.deleteRoom(r.name, "")
+		return
+	}
+	log.Debug("Room will be preserved")
+	s.clientLeft(r, client, reason)
 }
 
-// pipe creates a full-duplex pipe between the two sockets and
-// transfers data from one to the other.
-func pipe(host net.Conn, chan1 chan []byte, client net.Conn) error {
-	chan2 := chanFromConn(client)
-	for {
-		select {
-		case b1 := <-chan1:
-			if b1 == nil {
-				return fmt.Errorf("Host exited")
-			}
-			fmt.Printf("HOST: %s\n", string(b1))
-			n, err := client.Write(b1)
-			log.Debugf("HOST: wrote %d %s", n, err)
-		case b2 := <-chan2:
-			log.Debug("Still here")
-			if b2 == nil {
-				// Client exist
-				//close(chan1)
-				return nil
-			}
-			fmt.Printf("CLIENT: %s\n", string(b2))
-			n, err := host.Write(b2)
-			log.Debugf("CLIENT: wrote %d %s", n, err)
-		}
+func (s *server) setState(r *roomInfo, state string) {
+	s.rooms.Lock()
+	if r.state != STATE_CLOSED {
+		r.state = state
 	}
+	s.rooms.Unlock()
 }
 
-func (s *server) deleteRoom(room string) {
-	log.Debugf("Deleting room %s", room)
+// clientLeft hangs up on the client and opens the room to the next one
+func (s *server) clientLeft(r *roomInfo, client *comm.Comm, reason string) {
+	closeWithReason(client, reason)
 	s.rooms.Lock()
-	if _, ok := s.rooms.rooms[room]; !ok {
-		s.rooms.Unlock()
+	defer s.rooms.Unlock()
+	if r.state == STATE_CLOSED {
 		return
 	}
-	if s.rooms.rooms[room].host != nil {
-		s.rooms.rooms[room].host.Close()
-	}
-	if s.rooms.rooms[room].client != nil {
-		s.rooms.rooms[room].client.Close()
+	r.client = nil
+	r.state = STATE_WAITING
+	r.idleSince = time.Now()
+	atomic.StoreInt64(&r.stats.lastActive, 0)
+	log.Debugf("Client left room %s", r.name)
+}
+
+// deleteRoom closes a room, its owner hangs up on both ends telling them the reason if there is one.
+// It returns false if there was no such room.
+func (s *server) deleteRoom(room, reason string) bool {
+	log.Debugf("Deleting room %s", room)
+	s.rooms.Lock()
+	r, ok := s.rooms.rooms[room]
+	if !ok {
+		s.rooms.Unlock()
+		return false
 	}
 	delete(s.rooms.rooms, room)
+	r.state = STATE_CLOSED
+	r.reason = reason
+	close(r.done)
 	s.rooms.Unlock()
+	roomsActive.Add(-1)
+	return true
 }
 
-func (s *server) setupRoom(key []byte, conn *comm.Comm) (room *roomRole, err error) {
+// kickClient asks the owner of a room to drop its client, telling it why. The host keeps the room.
+func (s *server) kickClient(room, reason string) bool {
+	s.rooms.Lock()
+	defer s.rooms.Unlock()
+	r, ok := s.rooms.rooms[room]
+	if !ok || r.client == nil {
+		return false
+	}
+	select {
+	case r.kick <- kickRequest{client: r.client, reason: reason}:
+	default:
+		// Already being kicked
+	}
+	return true
+}
+
+// setupRoom reads what the connection wants and makes it the host or the client of a room
+func (s *server) setupRoom(key []byte, conn *comm.Comm) (room *roomInfo, role string, err error) {
 	log.Debug("Setup room here")
-	room = new(roomRole)
 	buf, err := conn.Receive()
 	if err != nil {
-		panic(err)
 		return
 	}
 	buf, err = crypt.Decrypt(buf, key)
 	if err != nil {
-		panic(err)
 		return
 	}
-	log.Debugf("Got room %s", string(buf))
-	room.room = string(buf)
+	req := parseRoomRequest(buf)
+	if req.Type == REQ_LIST {
+		// Nothing to join, this connection is done afterwards
+		err = s.listRooms(conn, key)
+		return
+	}
+	log.Debugf("Got room %s", req.Room)
+	// Past the handshake, the room's owner may take the connection from here
+	conn.SetTimeouts(comm.DefaultTimeouts)
+
+	var reply string
 	s.rooms.Lock()
-	log.Debug("got the lock")
-	if _, ok := s.rooms.rooms[room.room]; !ok {
-		// Room not already exist
-		// This is a host
-		log.Debugf("Create new room %s", room.room)
-		s.rooms.rooms[room.room] = roomInfo{
-			host:     conn,
-			client:   nil,
-			hostChan: chanFromConn(conn.Connection()),
-			opened:   time.Now(),
-			full:     false,
+	room, ok := s.rooms.rooms[req.Room]
+	switch {
+	case !ok:
+		log.Debugf("Create new room %s", req.Room)
+		room = s.newRoom(req, conn)
+		reply = "host"
+	case req.Type == REQ_HOST:
+		log.Debugf("Room %s already taken", req.Room)
+		reply = "taken"
+	case room.state != STATE_WAITING:
+		log.Debugf("Room %s already full", req.Room)
+		reply = "full"
+	default:
+		log.Debugf("Room %s has new client", req.Room)
+		room.client = conn
+		room.state = STATE_BRIDGED
+		reply = "client"
+	}
+	s.rooms.Unlock()
+
+	buf, err = crypt.Encrypt([]byte(reply), key)
+	if err == nil {
+		err = conn.Send(buf)
+	}
+	switch reply {
+	case "host":
+		if err != nil {
+			s.deleteRoom(req.Room, "")
+			return nil, "", err
 		}
-		buf2, err := crypt.Encrypt([]byte("host"), key)
+	case "client":
 		if err != nil {
-			s.rooms.Unlock()
-			return nil, err
+			s.clientLeft(room, conn, "")
+			return nil, "", err
 		}
-		err = conn.Send(buf2)
-		room.role = "host"
-	} else {
-		if s.rooms.rooms[room.room].full {
-			log.Debugf("Room %s already full", room.room)
-			buf, err = crypt.Encrypt([]byte("full"), key)
-			if err != nil {
-				s.rooms.Unlock()
-				return nil, err
-			}
-			err = conn.Send(buf)
-		} else {
-			log.Debugf("Room %s has new client", room.room)
-			s.rooms.rooms[room.room] = roomInfo{
-				host:     s.rooms.rooms[room.room].host,
-				client:   conn,
-				hostChan: s.rooms.rooms[room.room].hostChan,
-				opened:   s.rooms.rooms[room.room].opened,
-				full:     true,
-			}
-			buf2, err := crypt.Encrypt([]byte("client"), key)
-			if err != nil {
-				s.rooms.Unlock()
-				return nil, err
-			}
-			err = conn.Send(buf2)
-			room.role = "client"
+		s.rooms.Lock()
+		if room.state == STATE_CLOSED {
+			s.rooms.Unlock()
+			closeWithReason(conn, room.reason)
+			return nil, "", nil
 		}
+		room.join <- joiner{conn: conn, addresses: req.Addresses}
+		s.rooms.Unlock()
 	}
-	s.rooms.Unlock()
-	return
+	return room, reply, nil
+}
+
+// newRoom registers a room with conn as its host, the caller must hold the lock
+func (s *server) newRoom(req RoomRequest, conn *comm.Comm) *roomInfo {
+	visibility := VISIBILITY_UNLISTED
+	if req.Type == REQ_HOST && req.Visibility == VISIBILITY_PUBLIC {
+		visibility = VISIBILITY_PUBLIC
+	}
+	room := &roomInfo{
+		name:         req.Room,
+		host:         conn,
+		state:        STATE_WAITING,
+		opened:       time.Now(),
+		idleSince:    time.Now(),
+		visibility:   visibility,
+		capabilities: req.Capabilities,
+		addresses:    req.Addresses,
+		stats: &roomStats{
+			toClientLimit: s.limiter.roomBucket(),
+			toHostLimit:   s.limiter.roomBucket(),
+		},
+		join: make(chan joiner, 1),
+		kick: make(chan kickRequest, 1),
+		done: make(chan struct{}),
+	}
+	s.rooms.rooms[req.Room] = room
+	roomsActive.Add(1)
+	return room
 }
 
 var weakKey = []byte{1, 2, 3}
 
-func (s *server) authenticate(c *comm.Comm) (strongKeyForEncryption []byte, err error) {
+var errBadPassword = fmt.Errorf("bad password")
+
+var handshakeTimeouts = comm.Timeouts{
+	Idle:  30 * time.Second,
+	Read:  30 * time.Second,
+	Write: 30 * time.Second,
+}
+
+// authenticate is the relay's side of the PAKE handshake, checking the peer knows password
+func authenticate(c *comm.Comm, password string) (strongKeyForEncryption []byte, err error) {
 	// PAKE stuff
 	B, err := pake.InitCurve(weakKey, 1, "siec", 1*time.Millisecond)
 	if err != nil {
@@ -365,9 +675,9 @@ func (s *server) authenticate(c *comm.Comm) (strongKeyForEncryption []byte, err
 	if err != nil {
 		return
 	}
-	if strings.TrimSpace(string(passwordBytes)) != s.password {
-		err = fmt.Errorf("bad password")
-		enc, _ := crypt.Decrypt([]byte(err.Error()), strongKeyForEncryption)
+	if strings.TrimSpace(string(passwordBytes)) != password {
+		err = errBadPassword
+		enc, _ := crypt.Encrypt([]byte(err.Error()), strongKeyForEncryption)
 		c.Send(enc)
 		return
 	}
@@ -376,15 +686,63 @@ func (s *server) authenticate(c *comm.Comm) (strongKeyForEncryption []byte, err
 	return
 }
 
+// ConnectToTCPServer joins room on the relay at address over TCP
+// ws:// and wss:// addresses are reached over WebSocket instead.
 func ConnectToTCPServer(address, password, room string, timelimit ...time.Duration) (c *comm.Comm, err error) {
-	if len(timelimit) > 0 {
-		c, err = comm.NewConnection(address, timelimit[0])
-	} else {
-		c, err = comm.NewConnection(address)
+	return ConnectToServer(comm.TransportFor(address), address, password, room, timelimit...)
+}
+
+// ConnectToServer joins room on the relay reached through transport
+func ConnectToServer(transport comm.Transport, address, password, room string, timelimit ...time.Duration) (c *comm.Comm, err error) {
+	return joinRoom(transport, address, password, []byte(room), timelimit...)
+}
+
+func joinRoom(transport comm.Transport, address, password string, request []byte, timelimit ...time.Duration) (c *comm.Comm, err error) {
+	c, strongKeyForEncryption, err := dialRelay(transport, address, password, timelimit...)
+	if err != nil {
+		return
 	}
+
+	log.Debug("Sending room info")
+	data2, err := crypt.Encrypt(request, strongKeyForEncryption)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.Send(data2)
+
+	log.Debug("Waiting for second ok")
+	enc2, err := c.Receive()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	data, err := crypt.Decrypt(enc2, strongKeyForEncryption)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if !bytes.Equal(data, []byte("host")) && !bytes.Equal(data, []byte("client")) {
+		c.Close()
+		return nil, fmt.Errorf("Could not join room: %s", data)
+	}
+
+	log.Debug("All set")
+	return
+}
+
+// dialRelay connects and authenticates with the relay, returning the key for further messages
+func dialRelay(transport comm.Transport, address, password string, timelimit ...time.Duration) (c *comm.Comm, strongKeyForEncryption []byte, err error) {
+	c, err = comm.Dial(transport, address, timelimit...)
 	if err != nil {
 		return
 	}
+	defer func() {
+		if err != nil {
+			c.Close()
+			c = nil
+		}
+	}()
 
 	// get PAKE connection with server to establish strong key to transfer info
 	A, err := pake.InitCurve(weakKey, 0, "siec", 1*time.Millisecond)
@@ -414,6 +772,9 @@ func ConnectToTCPServer(address, password, room string, timelimit ...time.Durati
 	log.Debugf("strong key: %x", strongKey)
 
 	strongKeyForEncryption, salt, err := crypt.New(strongKey, nil)
+	if err != nil {
+		return
+	}
 	// send salt
 	err = c.Send(salt)
 	if err != nil {
@@ -439,35 +800,8 @@ func ConnectToTCPServer(address, password, room string, timelimit ...time.Durati
 		return
 	}
 	if !bytes.Equal(data, []byte("ok")) {
-		log.Error("wrong password")
+		err = fmt.Errorf("wrong password")
 		return
 	}
-
-	log.Debug("Sending room info")
-	data2, err := crypt.Encrypt([]byte(room), strongKeyForEncryption)
-	if err != nil {
-		return
-	}
-	c.Send(data2)
-
-	log.Debug("Waiting for second ok")
-	enc2, err := c.Receive()
-	if err != nil {
-		return
-	}
-	data, err = crypt.Decrypt(enc2, strongKeyForEncryption)
-	if err != nil {
-		return
-	}
-	if bytes.Equal(data, []byte("full")) {
-		log.Error("room is full")
-		return
-	}
-	if !bytes.Equal(data, []byte("host")) && !bytes.Equal(data, []byte("client")) {
-		log.Errorf("Instead of ok received %s", data)
-		return
-	}
-
-	log.Debug("All set")
 	return
 }
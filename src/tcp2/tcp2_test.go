@@ -1,10 +1,27 @@
-package tcp2
+package tcp2_test
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/miska12345/MiskaRFS/src/comm"
 	"github.com/miska12345/MiskaRFS/src/tcp2"
 
 	"github.com/stretchr/testify/assert"
@@ -54,3 +71,626 @@ func TestTCP(t *testing.T) {
 	time.Sleep(1 * time.Second)
 	c2.Close()
 }
+
+func TestWebSocket(t *testing.T) {
+	// Host reaches the relay in memory, client tunnels through HTTP
+	memory := comm.NewMemory()
+	ml, err := memory.Listen("relay")
+	assert.Nil(t, err)
+	srv := httptest.NewUnstartedServer(nil)
+	wsl := comm.NewWebSocketListener(srv.Listener.Addr())
+	srv.Config.Handler = wsl
+	srv.Start()
+	defer srv.Close()
+	defer wsl.Close()
+	go tcp2.RunWithConfig(&tcp2.Config{
+		Listeners:  []net.Listener{ml, wsl},
+		DebugLevel: "error",
+	})
+
+	h, err := tcp2.ConnectToServer(memory, "relay", "", "websocket")
+	assert.Nil(t, err)
+	defer h.Close()
+	c, err := tcp2.ConnectToTCPServer("ws://"+srv.Listener.Addr().String()+"/", "", "websocket")
+	assert.Nil(t, err)
+	defer c.Close()
+
+	big := bytes.Repeat([]byte("Hello, World!"), 10000)
+	received := make(chan []byte)
+	go func() {
+		for {
+			data, err := h.Receive()
+			if err != nil || !bytes.Equal(data, []byte{1}) {
+				received <- data
+				return
+			}
+		}
+	}()
+
+	for {
+		data, err := c.Receive()
+		assert.Nil(t, err)
+		if err != nil || bytes.Equal(data, []byte("ok")) {
+			break
+		}
+	}
+	assert.Nil(t, c.Send(big))
+	assert.Equal(t, big, <-received)
+	assert.Nil(t, h.Send([]byte("Bye")))
+	data, err := c.Receive()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("Bye"), data)
+}
+
+// writeCert signs a certificate for name with parent, self-signed if parent is nil, and writes it to dir
+func writeCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	assert.Nil(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	return cert, key
+}
+
+func TestTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcp2")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	ca, caKey := writeCert(t, dir, "ca", nil, nil)
+	writeCert(t, dir, "relay", ca, caKey)
+	writeCert(t, dir, "client", ca, caKey)
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	l, err := comm.TCP.Listen("127.0.0.1:0")
+	assert.Nil(t, err)
+	address := l.Addr().String()
+	go tcp2.RunWithConfig(&tcp2.Config{
+		Listeners:       []net.Listener{l},
+		DebugLevel:      "error",
+		TLSCertFile:     path("relay.crt"),
+		TLSKeyFile:      path("relay.key"),
+		TLSClientCAFile: path("ca.crt"),
+	})
+	time.Sleep(100 * time.Millisecond)
+
+	// Plain connections and unknown certificates are turned away
+	_, err = tcp2.ConnectToServer(comm.TCP, address, "", "tls", time.Second)
+	assert.NotNil(t, err)
+	config, err := comm.ClientTLSConfig("", "", "")
+	assert.Nil(t, err)
+	_, err = tcp2.ConnectToServer(comm.TLS(comm.TCP, config), address, "", "tls", time.Second)
+	assert.NotNil(t, err)
+	// A trusted relay still wants to see our certificate
+	config, err = comm.ClientTLSConfig(path("ca.crt"), "", "")
+	assert.Nil(t, err)
+	_, err = tcp2.ConnectToServer(comm.TLS(comm.TCP, config), address, "", "tls", time.Second)
+	assert.NotNil(t, err)
+
+	config, err = comm.ClientTLSConfig(path("ca.crt"), path("client.crt"), path("client.key"))
+	assert.Nil(t, err)
+	c, err := tcp2.ConnectToServer(comm.TLS(comm.TCP, config), address, "", "tls", time.Second)
+	assert.Nil(t, err)
+	c.Close()
+}
+
+func TestTLSSelfSigned(t *testing.T) {
+	memory := comm.NewMemory()
+	l, err := memory.Listen("relay")
+	assert.Nil(t, err)
+	go tcp2.RunWithConfig(&tcp2.Config{
+		Listeners:     []net.Listener{l},
+		DebugLevel:    "error",
+		TLSSelfSigned: true,
+	})
+	time.Sleep(100 * time.Millisecond)
+
+	_, err = tcp2.ConnectToServer(comm.TLS(memory, &tls.Config{}), "relay", "", "tls", time.Second)
+	assert.NotNil(t, err)
+	c, err := tcp2.ConnectToServer(comm.TLS(memory, &tls.Config{InsecureSkipVerify: true}), "relay", "", "tls", time.Second)
+	assert.Nil(t, err)
+	c.Close()
+}
+
+func TestListRooms(t *testing.T) {
+	memory := comm.NewMemory()
+	l, err := memory.Listen("relay")
+	assert.Nil(t, err)
+	go tcp2.RunWithConfig(&tcp2.Config{
+		Listeners:  []net.Listener{l},
+		DebugLevel: "error",
+		Password:   "secret",
+	})
+
+	_, err = tcp2.RegisterHost(memory, "relay", "secret", &tcp2.RoomRequest{
+		Room:         "alpha",
+		Visibility:   tcp2.VISIBILITY_PUBLIC,
+		Capabilities: []string{"cd", "ls"},
+	})
+	assert.Nil(t, err)
+	_, err = tcp2.RegisterHost(memory, "relay", "secret", &tcp2.RoomRequest{Room: "beta"})
+	assert.Nil(t, err)
+	_, err = tcp2.ConnectToServer(memory, "relay", "secret", "gamma")
+	assert.Nil(t, err)
+
+	// Nobody can take over a room
+	_, err = tcp2.RegisterHost(memory, "relay", "secret", &tcp2.RoomRequest{Room: "alpha"})
+	assert.NotNil(t, err)
+	// Listing needs the relay password
+	_, err = tcp2.ListRooms(memory, "relay", "guess")
+	assert.NotNil(t, err)
+
+	rooms, err := tcp2.ListRooms(memory, "relay", "secret")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(rooms))
+	assert.Equal(t, "alpha", rooms[0].Name)
+	assert.Equal(t, 0, rooms[0].Clients)
+	assert.Equal(t, []string{"cd", "ls"}, rooms[0].Capabilities)
+
+	_, err = tcp2.ConnectToServer(memory, "relay", "secret", "alpha")
+	assert.Nil(t, err)
+	rooms, err = tcp2.ListRooms(memory, "relay", "secret")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, rooms[0].Clients)
+}
+
+func TestAdmin(t *testing.T) {
+	memory := comm.NewMemory()
+	l, err := memory.Listen("relay")
+	assert.Nil(t, err)
+	al, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go tcp2.RunWithConfig(&tcp2.Config{
+		Listeners:     []net.Listener{l},
+		DebugLevel:    "error",
+		AdminListener: al,
+		AdminToken:    "letmein",
+	})
+	api := func(method, path, token string) *http.Response {
+		req, err := http.NewRequest(method, "http://"+al.Addr().String()+path, nil)
+		assert.Nil(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		return res
+	}
+
+	h, err := tcp2.RegisterHost(memory, "relay", "", &tcp2.RoomRequest{Room: "admin"})
+	assert.Nil(t, err)
+	hostData := make(chan []byte, 10)
+	go func() {
+		for {
+			data, err := h.Receive()
+			if err != nil {
+				close(hostData)
+				return
+			}
+			if !bytes.Equal(data, []byte{1}) {
+				hostData <- data
+			}
+		}
+	}()
+	c, err := tcp2.ConnectToServer(memory, "relay", "", "admin")
+	assert.Nil(t, err)
+	data, err := c.Receive()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("ok"), data)
+	assert.Nil(t, c.Send([]byte("Hello, World!")))
+	assert.Equal(t, []byte("Hello, World!"), <-hostData)
+
+	assert.Equal(t, http.StatusUnauthorized, api("GET", "/api/rooms", "guess").StatusCode)
+	res := api("GET", "/api/rooms", "letmein")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	var rooms []tcp2.AdminRoom
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(&rooms))
+	res.Body.Close()
+	assert.Equal(t, 1, len(rooms))
+	assert.Equal(t, "admin", rooms[0].Name)
+	assert.Equal(t, tcp2.STATE_BRIDGED, rooms[0].State)
+	assert.NotEqual(t, "", rooms[0].Host)
+	assert.NotEqual(t, "", rooms[0].Client)
+	// Length prefix plus the message
+	assert.Equal(t, uint64(4+13), rooms[0].BytesToHost)
+
+	res = api("GET", "/", "")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	res.Body.Close()
+
+	// The relay waits for the client to take the notice
+	reason := make(chan string, 1)
+	go func() {
+		reason <- closeNotice(t, c)
+	}()
+	assert.Equal(t, http.StatusNoContent, api("POST", "/api/kick?room=admin", "letmein").StatusCode)
+	assert.Equal(t, tcp2.REASON_KICKED, <-reason)
+	_, err = c.Receive()
+	assert.NotNil(t, err)
+
+	assert.Equal(t, http.StatusNoContent, api("POST", "/api/close?room=admin", "letmein").StatusCode)
+	for range hostData {
+	}
+	assert.Equal(t, http.StatusNotFound, api("POST", "/api/close?room=admin", "letmein").StatusCode)
+}
+
+func TestLimits(t *testing.T) {
+	memory := comm.NewMemory()
+	l, err := memory.Listen("relay")
+	assert.Nil(t, err)
+	go tcp2.RunWithConfig(&tcp2.Config{
+		Listeners:  []net.Listener{l},
+		DebugLevel: "error",
+		Password:   "secret",
+		Limits: tcp2.Limits{
+			MaxConnectionsPerIP:  2,
+			RoomBytesPerSecond:   128 * 1024,
+			BanAfterBadPasswords: 2,
+			BanDuration:          time.Minute,
+		},
+	})
+
+	h, err := tcp2.RegisterHost(memory, "relay", "secret", &tcp2.RoomRequest{Room: "limits"})
+	assert.Nil(t, err)
+	hostData := make(chan []byte, 10)
+	go func() {
+		for {
+			data, err := h.Receive()
+			if err != nil {
+				close(hostData)
+				return
+			}
+			if !bytes.Equal(data, []byte{1}) {
+				hostData <- data
+			}
+		}
+	}()
+	c, err := tcp2.ConnectToServer(memory, "relay", "secret", "limits")
+	assert.Nil(t, err)
+	data, err := c.Receive()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("ok"), data)
+
+	// Every memory connection comes from the same address
+	_, err = tcp2.ConnectToServer(memory, "relay", "secret", "other", time.Second)
+	assert.NotNil(t, err)
+
+	// The first 128 KiB go through at once, the rest at 128 KiB a second
+	start := time.Now()
+	assert.Nil(t, c.Send(make([]byte, 256*1024)))
+	assert.Equal(t, 256*1024, len(<-hostData))
+	assert.True(t, time.Since(start) > 500*time.Millisecond, "%s", time.Since(start))
+
+	// Leaving the room frees the client's connection
+	c.Close()
+	time.Sleep(200 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		_, err = tcp2.ListRooms(memory, "relay", "guess")
+		assert.EqualError(t, err, "wrong password")
+		// The relay hangs up right after answering
+		time.Sleep(100 * time.Millisecond)
+	}
+	// Banned, even with the right password
+	_, err = tcp2.ListRooms(memory, "relay", "secret", time.Second)
+	assert.NotNil(t, err)
+}
+
+// closeNotice waits for the relay to hang up on c and returns why
+func closeNotice(t *testing.T, c *comm.Comm) string {
+	for {
+		data, err := c.Receive()
+		if !assert.Nil(t, err) {
+			return ""
+		}
+		if closed := tcp2.ParseCloseNotice(data); closed != nil {
+			return closed.Reason
+		}
+	}
+}
+
+func TestRoomPolicy(t *testing.T) {
+	memory := comm.NewMemory()
+	l, err := memory.Listen("relay")
+	assert.Nil(t, err)
+	go tcp2.RunWithConfig(&tcp2.Config{
+		Listeners:  []net.Listener{l},
+		DebugLevel: "error",
+		Policy: tcp2.RoomPolicy{
+			ClientIdle: time.Second,
+			HostIdle:   2 * time.Second,
+		},
+	})
+
+	h, err := tcp2.RegisterHost(memory, "relay", "", &tcp2.RoomRequest{Room: "idle"})
+	assert.Nil(t, err)
+	reason := make(chan string, 1)
+	go func() {
+		reason <- closeNotice(t, h)
+	}()
+	c, err := tcp2.ConnectToServer(memory, "relay", "", "idle")
+	assert.Nil(t, err)
+	data, err := c.Receive()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("ok"), data)
+
+	// The client never says anything, then the host never gets another client
+	start := time.Now()
+	assert.Equal(t, tcp2.REASON_CLIENT_IDLE, closeNotice(t, c))
+	assert.True(t, time.Since(start) >= time.Second, "%s", time.Since(start))
+	assert.Equal(t, tcp2.REASON_HOST_IDLE, <-reason)
+	assert.True(t, time.Since(start) >= 3*time.Second, "%s", time.Since(start))
+
+	memory = comm.NewMemory()
+	l, err = memory.Listen("relay")
+	assert.Nil(t, err)
+	go tcp2.RunWithConfig(&tcp2.Config{
+		Listeners:  []net.Listener{l},
+		DebugLevel: "error",
+		Policy:     tcp2.RoomPolicy{MaxLifetime: time.Second},
+	})
+	h, err = tcp2.RegisterHost(memory, "relay", "", &tcp2.RoomRequest{Room: "short"})
+	assert.Nil(t, err)
+	assert.Equal(t, tcp2.REASON_EXPIRED, closeNotice(t, h))
+}
+
+func TestBridgeFrames(t *testing.T) {
+	memory := comm.NewMemory()
+	l, err := memory.Listen("relay")
+	assert.Nil(t, err)
+	go tcp2.Serve(l, "error", "")
+
+	h, err := tcp2.RegisterHost(memory, "relay", "", &tcp2.RoomRequest{Room: "frames"})
+	assert.Nil(t, err)
+	hostData := make(chan []byte, 10)
+	go func() {
+		for {
+			data, err := h.Receive()
+			if err != nil {
+				close(hostData)
+				return
+			}
+			if !bytes.Equal(data, []byte{1}) {
+				hostData <- data
+			}
+		}
+	}()
+	join := func() *comm.Comm {
+		c, err := tcp2.ConnectToServer(memory, "relay", "", "frames")
+		assert.Nil(t, err)
+		data, err := c.Receive()
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("ok"), data)
+		return c
+	}
+
+	// A client leaving halfway through a frame must not leave the host with half of it
+	c := join()
+	_, err = c.Connection().Write([]byte{100, 0, 0, 0, 'h', 'a', 'l', 'f'})
+	assert.Nil(t, err)
+	c.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	c = join()
+	assert.Nil(t, c.Send([]byte("whole")))
+	assert.Equal(t, []byte("whole"), <-hostData)
+
+	// Requests are small, a client announcing a frame far larger than any is let go before the host sees it
+	_, err = c.Connection().Write([]byte{0, 0, 0, 1})
+	assert.Nil(t, err)
+	_, err = c.Receive()
+	assert.NotNil(t, err)
+	c.Close()
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case data := <-hostData:
+		t.Errorf("host got %q", data)
+	default:
+	}
+	c = join()
+
+	// Frames larger than the relay's buffer arrive whole, and the client still gets them when the host leaves
+	big := make([]byte, 3*64*1024+7)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	go func() {
+		assert.Nil(t, h.Send(big))
+		h.Close()
+	}()
+	data, err := c.Receive()
+	assert.Nil(t, err)
+	assert.Equal(t, big, data)
+	_, err = c.Receive()
+	assert.NotNil(t, err)
+}
+
+func TestRoomCycle(t *testing.T) {
+	memory := comm.NewMemory()
+	l, err := memory.Listen("relay")
+	assert.Nil(t, err)
+	go tcp2.Serve(l, "error", "")
+
+	// The host echoes everything back
+	h, err := tcp2.RegisterHost(memory, "relay", "", &tcp2.RoomRequest{Room: "cycle"})
+	assert.Nil(t, err)
+	go func() {
+		for {
+			data, err := h.Receive()
+			if err != nil {
+				return
+			}
+			if !bytes.Equal(data, []byte{1}) {
+				h.Send(data)
+			}
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		// The room takes a moment to notice the last client left
+		var c *comm.Comm
+		for try := 0; c == nil; try++ {
+			c, err = tcp2.ConnectToServer(memory, "relay", "", "cycle")
+			if err != nil {
+				assert.EqualError(t, err, "Could not join room: full")
+				assert.True(t, try < 100, "room never opened up again")
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+		data, err := c.Receive()
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("ok"), data)
+
+		message := []byte(fmt.Sprintf("client %d", i))
+		assert.Nil(t, c.Send(message))
+		data, err = c.Receive()
+		assert.Nil(t, err)
+		assert.Equal(t, message, data)
+
+		// Some leave rudely, halfway through their next frame
+		if i%5 == 0 {
+			_, err = c.Connection().Write([]byte{100, 0, 0, 0, 'b', 'y', 'e'})
+			assert.Nil(t, err)
+		}
+		c.Close()
+	}
+}
+
+func TestWaitingRoom(t *testing.T) {
+	memory := comm.NewMemory()
+	l, err := memory.Listen("relay")
+	assert.Nil(t, err)
+	go tcp2.Serve(l, "error", "")
+
+	h, err := tcp2.RegisterHost(memory, "relay", "", &tcp2.RoomRequest{Room: "waiting"})
+	assert.Nil(t, err)
+	join := func() *comm.Comm {
+		c, err := tcp2.ConnectToServer(memory, "relay", "", "waiting")
+		assert.Nil(t, err)
+		data, err := c.Receive()
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("ok"), data)
+		return c
+	}
+
+	// What the host answers after its client left never reaches the next one
+	c := join()
+	c.Close()
+	time.Sleep(100 * time.Millisecond)
+	go func() {
+		h.Send([]byte("stale"))
+		h.Send(make([]byte, 3*64*1024))
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	c = join()
+	assert.Nil(t, c.Send([]byte("request")))
+	for {
+		data, err := h.Receive()
+		assert.Nil(t, err)
+		if err != nil || !bytes.Equal(data, []byte{1}) {
+			assert.Equal(t, []byte("request"), data)
+			break
+		}
+	}
+	assert.Nil(t, h.Send([]byte("fresh")))
+	data, err := c.Receive()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("fresh"), data)
+	c.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	// A host gone while nobody is there is noticed without waiting for a heartbeat
+	h.Close()
+	time.Sleep(100 * time.Millisecond)
+	h, err = tcp2.RegisterHost(memory, "relay", "", &tcp2.RoomRequest{Room: "waiting"})
+	assert.Nil(t, err)
+	if err == nil {
+		h.Close()
+	}
+}
+
+// benchmarkBridge sends frames of size bytes from a host to a client through a relay on loopback TCP,
+// or from the client to the host with toHost
+func benchmarkBridge(b *testing.B, size int, toHost bool) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	go tcp2.RunWithConfig(&tcp2.Config{
+		Listeners:  []net.Listener{l},
+		DebugLevel: "error",
+	})
+	address := l.Addr().String()
+	h, err := tcp2.RegisterHost(comm.TCP, address, "", &tcp2.RoomRequest{Room: "bench"})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer h.Close()
+	c, err := tcp2.ConnectToServer(comm.TCP, address, "", "bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.Close()
+	if data, err := c.Receive(); err != nil || !bytes.Equal(data, []byte("ok")) {
+		b.Fatal(data, err)
+	}
+
+	from, to := h, c
+	if toHost {
+		from, to = c, h
+	}
+	frame := make([]byte, size)
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	go func() {
+		for i := 0; i < b.N; i++ {
+			if err := from.Send(frame); err != nil {
+				return
+			}
+		}
+	}()
+	for i := 0; i < b.N; {
+		data, err := to.Receive()
+		if err != nil {
+			b.Fatal(err)
+		}
+		// The relay's heartbeats reach the host too
+		if len(data) == size {
+			i++
+		}
+		comm.Recycle(data)
+	}
+}
+
+func BenchmarkBridge4K(b *testing.B) {
+	benchmarkBridge(b, 4*1024, false)
+}
+
+func BenchmarkBridge1M(b *testing.B) {
+	benchmarkBridge(b, 1024*1024, false)
+}
+
+func BenchmarkBridgeToHost4K(b *testing.B) {
+	benchmarkBridge(b, 4*1024, true)
+}
+
+func BenchmarkBridgeToHost1M(b *testing.B) {
+	benchmarkBridge(b, 1024*1024, true)
+}